@@ -1,8 +1,10 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net"
 	"net/url"
 	"os"
@@ -10,6 +12,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
 // labelFromSource derives a short, human-readable nginx-safe label from a source identifier.
@@ -17,7 +20,10 @@ import (
 //   - "https://raw.githubusercontent.com/stamparm/ipsum/…/levels/8.txt" → "ipsum-8"
 //   - "https://www.ipdeny.com/…/cn-aggregated.zone"                       → "cn"
 //   - "https://rules.emergingthreats.net/…/emerging-Block-IPs.txt"        → "emerging-block-ips"
+//   - "https://rules.emergingthreats.net/…/emerging-drop.rules#et-drop-spamhaus" → "et-drop-spamhaus"
 //   - "local_blocklist"                                                    → "local"
+//
+// A fragment carries a per-entry label chosen by the parser (see parseRules) and wins over the URL.
 func labelFromSource(source string) string {
 	if source == "local_blocklist" || source == "local_whitelist" {
 		return "local"
@@ -26,6 +32,9 @@ func labelFromSource(source string) string {
 	if err != nil || u.Host == "" {
 		return source
 	}
+	if u.Fragment != "" {
+		return u.Fragment
+	}
 	base := path.Base(u.Path)
 	name := strings.TrimSuffix(base, path.Ext(base))
 	name = strings.ToLower(name)
@@ -54,6 +63,15 @@ func labelFromSource(source string) string {
 	return name
 }
 
+// sourceKey strips a parser-assigned label fragment from a source identifier, giving the
+// URL as configured in remote_blocklists (and as keyed in source_options).
+func sourceKey(source string) string {
+	if i := strings.Index(source, "#"); i >= 0 {
+		return source[:i]
+	}
+	return source
+}
+
 // isAmbiguousLabel returns true when a label is all-digits or very short,
 // meaning it needs a prefix to be meaningful.
 func isAmbiguousLabel(name string) bool {
@@ -68,50 +86,63 @@ func isAmbiguousLabel(name string) bool {
 	return true // all digits
 }
 
-// writeBlocklistFile creates an NGINX configuration file for blocking IPs, considering whitelisted IPs.
-// The geo variable $blocked_source is set to a label identifying the originating blocklist(s),
-// or "" (empty string, falsy in nginx) for addresses that are not blocked.
-// The write is atomic: content is staged in a temp file and renamed into place, so nginx
-// never sees a partially written config even if the process crashes mid-write.
-func writeBlocklistFile(whitelist map[string]string, blocklist map[string][]string, filePath string) error {
-	if err := validateConfFilePath(filePath); err != nil {
-		return fmt.Errorf("refusing to write blocklist: %v", err)
-	}
+// blocklistEntry is one network of the final, whitelist-carved blocklist.
+type blocklistEntry struct {
+	addr     string   // original blocklist entry, or a carved sub-range of it
+	label    string   // "+"-joined source labels, as written to $blocked_source
+	sources  []string // contributing source identifiers (URLs or "local_blocklist")
+	original string   // blocklist entry addr was derived from (equal to addr unless split)
+	carvedBy []string // whitelist entries subtracted from original, sorted
+}
 
-	dir := filepath.Dir(filePath)
-	tmp, err := os.CreateTemp(dir, ".blocklist-*.conf.tmp")
-	if err != nil {
-		return fmt.Errorf("failed to create temp file in %s: %v", dir, err)
-	}
-	tmpName := tmp.Name()
+// Carve results reported for each final entry.
+const (
+	carveUnchanged = "unchanged" // no whitelist overlap; the entry is emitted as listed
+	carveSplit     = "split"     // whitelisted addresses were carved out; addr is one remaining sub-range
+)
 
-	// On any failure, clean up the temp file.
-	committed := false
-	defer func() {
-		if !committed {
-			os.Remove(tmpName)
-		}
-	}()
+// carveResult reports how the whitelist affected the entry.
+func (e blocklistEntry) carveResult() string {
+	if len(e.carvedBy) > 0 {
+		return carveSplit
+	}
+	return carveUnchanged
+}
 
-	file := tmp
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil && !committed {
-			logf("Failed to close temp file: %v\n", err)
+// parseNetwork parses an IP or CIDR into a network; single IPs become /32 for IPv4 or /128 for IPv6.
+// Returns nil if the string is neither.
+func parseNetwork(address string) *net.IPNet {
+	if ip := net.ParseIP(address); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
 		}
-	}(file)
-
-	writer := bufio.NewWriter(file)
-	_, err = writer.WriteString("# blocklist.conf\n\ngeo $blocked_source {\n    default        \"\";\n\n")
+		return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+	}
+	_, ipNet, err := net.ParseCIDR(address)
 	if err != nil {
-		return err
+		return nil
 	}
+	return ipNet
+}
+
+// carveBlocklist subtracts every whitelist entry from the blocklist and returns the remaining
+// networks sorted by address. Blocklist CIDRs that partially overlap a whitelist entry are split
+// into the minimal set of sub-ranges that excludes the whitelisted addresses.
+// Every output format is rendered from the result, so carving happens exactly once per run.
+func carveBlocklist(whitelist map[string]string, blocklist map[string][]string) []blocklistEntry {
+	var entries []blocklistEntry
 
-	type addrEntry struct {
-		addr  string
-		label string
+	// Parse the whitelist once up front; it is applied to every blocklist entry.
+	type whitelistNet struct {
+		entry string
+		net   *net.IPNet
+	}
+	whitelistNets := make([]whitelistNet, 0, len(whitelist))
+	for wlEntry := range whitelist {
+		if n := parseNetwork(wlEntry); n != nil {
+			whitelistNets = append(whitelistNets, whitelistNet{entry: wlEntry, net: n})
+		}
 	}
-	var entries []addrEntry
 
 	for address, blocklistSources := range blocklist {
 		// Derive the nginx label: join all source labels with "+"
@@ -121,47 +152,33 @@ func writeBlocklistFile(whitelist map[string]string, blocklist map[string][]stri
 		}
 		blocklistLabel := strings.Join(labels, "+")
 
-		// Parse blocklist entry as a network (single IPs become /32 for IPv4 or /128 for IPv6)
-		var baseNet *net.IPNet
-		if ip := net.ParseIP(address); ip != nil {
-			if ip4 := ip.To4(); ip4 != nil {
-				baseNet = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
-			} else {
-				baseNet = &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
-			}
-		} else {
-			var parseErr error
-			_, baseNet, parseErr = net.ParseCIDR(address)
-			if parseErr != nil {
-				continue
-			}
+		baseNet := parseNetwork(address)
+		if baseNet == nil {
+			continue
 		}
 
 		// Subtract all whitelist entries from this blocklist network
 		remaining := []*net.IPNet{baseNet}
-		for wlEntry := range whitelist {
-			var excludeNet *net.IPNet
-			if ip := net.ParseIP(wlEntry); ip != nil {
-				if ip4 := ip.To4(); ip4 != nil {
-					excludeNet = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
-				} else {
-					excludeNet = &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
-				}
-			} else {
-				_, excludeNet, _ = net.ParseCIDR(wlEntry)
-			}
-			if excludeNet == nil {
-				continue
-			}
+		var carvedBy []string
+		for _, wl := range whitelistNets {
+			excludeNet := wl.net
 			var next []*net.IPNet
+			overlapped := false
 			for _, subnet := range remaining {
+				if subnet.Contains(excludeNet.IP) || excludeNet.Contains(subnet.IP) {
+					overlapped = true
+				}
 				next = append(next, subtractCIDR(subnet, excludeNet)...)
 			}
+			if overlapped {
+				carvedBy = append(carvedBy, wl.entry)
+			}
 			remaining = next
 			if len(remaining) == 0 {
 				break
 			}
 		}
+		sort.Strings(carvedBy)
 
 		if len(remaining) == 0 {
 			// Entirely whitelisted
@@ -173,13 +190,18 @@ func writeBlocklistFile(whitelist map[string]string, blocklist map[string][]stri
 			}
 		} else if len(remaining) == 1 && remaining[0].String() == baseNet.String() {
 			// No whitelist overlap; keep original entry as-is
-			entries = append(entries, addrEntry{addr: address, label: blocklistLabel})
+			entries = append(entries, blocklistEntry{
+				addr: address, label: blocklistLabel, sources: blocklistSources, original: address,
+			})
 		} else {
 			// Partial overlap: emit carved subnets, omitting whitelisted portions
 			logf("Splitting blocklist CIDR %s (from %s): retaining %d sub-ranges after whitelist exclusions\n",
 				address, blocklistLabel, len(remaining))
 			for _, subnet := range remaining {
-				entries = append(entries, addrEntry{addr: subnet.String(), label: blocklistLabel})
+				entries = append(entries, blocklistEntry{
+					addr: subnet.String(), label: blocklistLabel, sources: blocklistSources,
+					original: address, carvedBy: carvedBy,
+				})
 			}
 		}
 	}
@@ -187,32 +209,307 @@ func writeBlocklistFile(whitelist map[string]string, blocklist map[string][]stri
 		return entries[i].addr < entries[j].addr
 	})
 
+	return entries
+}
+
+// renderGeoFile renders the carved entries as the nginx geo include, after a comment header
+// describing the run (see renderGeoHeader).
+// The geo variable $blocked_source is set to a label identifying the originating blocklist(s),
+// or "" (empty string, falsy in nginx) for addresses that are not blocked.
+// When sources are assigned severity tiers, a companion map $etr_action follows (see renderTierMap);
+// when any source is in shadow mode, so does geo $etr_shadow_source (see renderShadowGeo).
+func renderGeoFile(gen *generation) ([]byte, error) {
+	return renderGeoMaster(gen, gen.entries, nil)
+}
+
+// writeGeoEntries writes one "    <network>    <label>;" line per entry.
+func writeGeoEntries(b *bytes.Buffer, entries []blocklistEntry) {
 	for _, e := range entries {
-		_, err = writer.WriteString(fmt.Sprintf("    %s    %s;\n", e.addr, e.label))
+		fmt.Fprintf(b, "    %s    %s;\n", e.addr, e.label)
+	}
+}
+
+// renderGeoMaster renders blocklist.conf: the geo $blocked_source block holds the entries
+// inline, or include directives for the given paths in the per-source layout. An
+// nginx_geo_template replaces the block's layout; an error executing it is returned, so the run
+// fails before any file is replaced.
+func renderGeoMaster(gen *generation, entries []blocklistEntry, includes []string) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("# blocklist.conf\n\n")
+	b.Write(renderGeoHeader(gen))
+	b.WriteString("\n")
+	if gen.geoTemplate != nil {
+		if err := renderGeoTemplate(&b, gen, entries, includes); err != nil {
+			return nil, fmt.Errorf("nginx_geo_template: %v", err)
+		}
+		b.WriteString(renderGeoFooter(gen))
+		return b.Bytes(), nil
+	}
+	b.WriteString("geo $blocked_source {\n    default        \"\";\n\n")
+	if includes != nil {
+		b.WriteString("    # Comment out an include to stop enforcing that source until the next run.\n")
+		for _, include := range includes {
+			fmt.Fprintf(&b, "    include %s;\n", include)
+		}
+	} else {
+		writeGeoEntries(&b, entries)
+	}
+	b.WriteString("\n}")
+	b.WriteString(renderGeoFooter(gen))
+	return b.Bytes(), nil
+}
+
+// renderGeoFooter renders the companion blocks that follow geo $blocked_source.
+func renderGeoFooter(gen *generation) string {
+	var b bytes.Buffer
+	if tiersConfigured(gen.sources) {
+		b.WriteString("\n\n")
+		b.Write(renderTierMap(gen))
+	}
+	if shadowConfigured(gen.sources) {
+		b.WriteString("\n\n")
+		b.Write(renderShadowGeo(gen.shadow))
+	}
+	return b.String()
+}
+
+// whitelistConfFileName is the nginx include defining $etr_whitelisted. It is written next to
+// the blocklist so the same conf.d mount picks it up.
+const whitelistConfFileName = "whitelist.conf"
+
+// whitelistConfPath returns the location of the whitelist include for a given nginx conf path.
+func whitelistConfPath(confFilePath string) string {
+	return filepath.Join(filepath.Dir(confFilePath), whitelistConfFileName)
+}
+
+// renderWhitelistGeoFile renders the whitelist as a geo block in the same layout as the blocklist.
+// $etr_whitelisted is set to the label of the entry's whitelist source (e.g. "local"), or ""
+// otherwise, so nginx configs can exempt trusted clients from User-Agent checks and limit_req.
+// Entries that are not an IP or CIDR are skipped, as in carveBlocklist: one invalid line would
+// make nginx reject the whole file.
+func renderWhitelistGeoFile(whitelist map[string]string) []byte {
+	addrs := make([]string, 0, len(whitelist))
+	for addr := range whitelist {
+		if parseNetwork(addr) != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+
+	var b bytes.Buffer
+	b.WriteString("# whitelist.conf\n\ngeo $etr_whitelisted {\n    default        \"\";\n\n")
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "    %s    %s;\n", addr, labelFromSource(whitelist[addr]))
+	}
+	b.WriteString("\n}")
+	return b.Bytes()
+}
+
+// writeWhitelistFile writes the whitelist geo include to filePath.
+func writeWhitelistFile(whitelist map[string]string, filePath string) error {
+	if err := validateConfFilePath(filePath); err != nil {
+		return fmt.Errorf("refusing to write whitelist: %v", err)
+	}
+	if err := keepBackup(filePath); err != nil {
+		return fmt.Errorf("failed to back up whitelist file: %v", err)
+	}
+	if err := writeFileAtomic(filePath, renderWhitelistGeoFile(whitelist)); err != nil {
+		return fmt.Errorf("failed to atomically replace whitelist file: %v", err)
+	}
+	return nil
+}
+
+// writeBlocklistFile creates an NGINX configuration file for blocking IPs, considering whitelisted IPs.
+// See carveBlocklist for how whitelist entries are applied and renderGeoFile for the file layout.
+func writeBlocklistFile(whitelist map[string]string, blocklist map[string][]string, filePath string) error {
+	return writeGeoFile(&generation{
+		entries:      carveBlocklist(whitelist, blocklist),
+		whitelist:    whitelist,
+		generatedAt:  time.Now(),
+		listed:       len(blocklist),
+		sourceCounts: countSources(blocklist),
+	}, filePath)
+}
+
+// writeGeoFile writes the generation's carved entries to filePath as the nginx geo include,
+// followed by its .sha256 sidecar.
+func writeGeoFile(gen *generation, filePath string) error {
+	if err := validateConfFilePath(filePath); err != nil {
+		return fmt.Errorf("refusing to write blocklist: %v", err)
+	}
+	content, err := renderGeoFile(gen)
+	if err != nil {
+		return err
+	}
+	return writeSingleGeoMaster(filePath, content)
+}
+
+// writeSingleGeoMaster writes blocklist.conf in the single layout. Include files left from a
+// per_source layout are backed up first, as rollbackNginxFiles may need them again; pruneIncludes
+// removes them once the new file is final.
+func writeSingleGeoMaster(filePath string, content []byte) error {
+	if err := keepIncludeBackup(filePath); err != nil {
+		return fmt.Errorf("failed to back up include files: %v", err)
+	}
+	return writeGeoMaster(filePath, content)
+}
+
+// writeGeoMaster atomically replaces blocklist.conf and then its .sha256 sidecar, keeping the
+// previous version for rollbackNginxFiles.
+func writeGeoMaster(filePath string, content []byte) error {
+	if err := keepBackup(filePath); err != nil {
+		return fmt.Errorf("failed to back up blocklist file: %v", err)
+	}
+	if err := writeFileAtomic(filePath, content); err != nil {
+		return fmt.Errorf("failed to atomically replace blocklist file: %v", err)
+	}
+	if err := writeChecksumFile(filePath, content); err != nil {
+		return fmt.Errorf("failed to write blocklist checksum: %v", err)
+	}
+	return nil
+}
+
+// nginxFilesUnchanged reports whether the nginx files on disk already hold this generation:
+// blocklist.conf apart from its run header, whitelist.conf and, for the per-source layout,
+// exactly the include files it would write. Any file that cannot be rendered or read counts as a
+// change, so the write reports the error.
+func nginxFilesUnchanged(gen *generation, confFilePath, layout, nginxIncludeDir string) bool {
+	expected := []renderedFile{{path: whitelistConfPath(confFilePath), content: renderWhitelistGeoFile(gen.whitelist)}}
+	master, err := renderGeoFile(gen)
+	if layout == geoLayoutPerSource {
+		var includes []renderedFile
+		master, includes, err = renderPerSourceGeoFiles(gen, confFilePath, nginxIncludeDir)
 		if err != nil {
+			return false
+		}
+		existing, err := filepath.Glob(filepath.Join(filepath.Dir(confFilePath), includeDirName, "*.conf"))
+		if err != nil || len(existing) != len(includes) {
+			return false
+		}
+		expected = append(expected, includes...)
+	}
+
+	if err != nil {
+		return false
+	}
+	live, err := os.ReadFile(confFilePath)
+	if err != nil || !bytes.Equal(geoBody(live), geoBody(master)) {
+		return false
+	}
+	for _, f := range expected {
+		live, err := os.ReadFile(f.path)
+		if err != nil || !bytes.Equal(live, f.content) {
+			return false
+		}
+	}
+	return true
+}
+
+// backupPath is where the previous version of a live nginx include is kept. The suffix keeps
+// nginx's "include conf.d/*.conf" from loading it.
+func backupPath(filePath string) string {
+	return filePath + ".bak"
+}
+
+// keepBackup copies the current filePath to its backup before it is replaced. When there is no
+// current file any old backup is removed, so a rollback never restores a stale deployment.
+func keepBackup(filePath string) error {
+	content, err := os.ReadFile(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := os.Remove(backupPath(filePath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return err
 		}
+		return nil
 	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(backupPath(filePath), content)
+}
+
+// rollbackNote rolls the nginx files back with rollbackNginxFiles and describes the outcome for
+// the notification that reports why the new files were refused.
+func rollbackNote(confFilePath string) string {
+	if err := rollbackNginxFiles(confFilePath); err != nil {
+		return fmt.Sprintf("\n\nRollback failed: %v", err)
+	}
+	return "\n\nRestored the previous blocklist.conf, its include files and whitelist.conf."
+}
 
-	_, err = writer.WriteString("\n}")
+// rollbackNginxFiles puts the previous blocklist.conf (with a matching .sha256 sidecar), the
+// etr.d include files it references and whitelist.conf back in place after nginx or a hook
+// rejected the new ones, then removes the includes only the rejected version used. A missing
+// whitelist backup is not an error: deployments older than whitelist.conf have none.
+func rollbackNginxFiles(confFilePath string) error {
+	content, err := os.ReadFile(backupPath(confFilePath))
 	if err != nil {
+		return fmt.Errorf("no previous blocklist to restore: %v", err)
+	}
+	if err := restoreIncludes(confFilePath, content); err != nil {
 		return err
 	}
+	if err := writeFileAtomic(confFilePath, content); err != nil {
+		return fmt.Errorf("failed to restore %s: %v", confFilePath, err)
+	}
+	if err := writeChecksumFile(confFilePath, content); err != nil {
+		return fmt.Errorf("failed to restore blocklist checksum: %v", err)
+	}
 
-	if err := writer.Flush(); err != nil {
+	if err := pruneIncludes(confFilePath); err != nil {
 		return err
 	}
 
-	if err := file.Close(); err != nil {
+	whitelistPath := whitelistConfPath(confFilePath)
+	previous, err := os.ReadFile(backupPath(whitelistPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(whitelistPath, previous); err != nil {
+		return fmt.Errorf("failed to restore %s: %v", whitelistPath, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes content to filePath atomically: content is staged in a temp file in the
+// same directory and renamed into place, so readers (nginx, nft, ipset …) never see a partially
+// written file even if the process crashes mid-write.
+func writeFileAtomic(filePath string, content []byte) error {
+	dir := filepath.Dir(filePath)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filePath)+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file in %s: %v", dir, err)
+	}
+	tmpName := tmp.Name()
+
+	// On any failure, clean up the temp file.
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(tmpName)
+		}
+	}()
+
+	// CreateTemp uses 0600; outputs are read by other containers' unprivileged users
+	// (e.g. nginx workers serving the pf URL table), so make them world-readable.
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
 		return err
 	}
-	committed = true // prevent deferred close from double-closing
 
-	// Atomically replace the live file.
 	if err := os.Rename(tmpName, filePath); err != nil {
-		committed = false // rename failed; deferred cleanup will remove tmpName
-		return fmt.Errorf("failed to atomically replace blocklist file: %v", err)
+		return err
 	}
+	committed = true
 
 	return nil
 }
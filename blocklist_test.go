@@ -610,3 +610,93 @@ func TestBlocklistCIDRCarving(t *testing.T) {
     t.Error("carved sub-range 52.80.0.0/15 should be blocked")
   }
 }
+
+// TestWriteWhitelistFile verifies the $etr_whitelisted geo include mirrors the blocklist layout
+func TestWriteWhitelistFile(t *testing.T) {
+  whitelist := map[string]string{
+    "192.0.2.10":      "local_whitelist",
+    "198.51.100.0/24": "https://example.com/lists/monitoring.txt",
+  }
+
+  path := whitelistConfPath(t.TempDir() + "/blocklist.conf")
+  if err := writeWhitelistFile(whitelist, path); err != nil {
+    t.Fatalf("writeWhitelistFile: %v", err)
+  }
+
+  content, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatalf("failed to read file: %v", err)
+  }
+
+  expected := "# whitelist.conf\n\ngeo $etr_whitelisted {\n    default        \"\";\n\n" +
+    "    192.0.2.10    local;\n" +
+    "    198.51.100.0/24    monitoring;\n" +
+    "\n}"
+  if string(content) != expected {
+    t.Errorf("unexpected whitelist file:\n%s\nwant:\n%s", content, expected)
+  }
+}
+
+// TestWriteWhitelistFileSkipsInvalidEntries verifies an entry nginx cannot parse is left out
+func TestWriteWhitelistFileSkipsInvalidEntries(t *testing.T) {
+  whitelist := map[string]string{
+    "192.0.2.10": "local_whitelist",
+    "invalid-ip": "local_whitelist",
+  }
+
+  path := whitelistConfPath(t.TempDir() + "/blocklist.conf")
+  if err := writeWhitelistFile(whitelist, path); err != nil {
+    t.Fatalf("writeWhitelistFile: %v", err)
+  }
+
+  content, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatalf("failed to read file: %v", err)
+  }
+  if strings.Contains(string(content), "invalid-ip") {
+    t.Errorf("invalid entry must be skipped:\n%s", content)
+  }
+  if !strings.Contains(string(content), "    192.0.2.10    local;\n") {
+    t.Errorf("valid entry missing:\n%s", content)
+  }
+}
+
+func TestRollbackNginxFilesRestoresPreviousVersion(t *testing.T) {
+  path := t.TempDir() + "/blocklist.conf"
+  whitelistPath := whitelistConfPath(path)
+
+  if err := rollbackNginxFiles(path); err == nil {
+    t.Error("expected an error when there is no previous blocklist")
+  }
+
+  write := func(blocked string) {
+    whitelist := map[string]string{blocked: "local_whitelist"}
+    blocklist := map[string][]string{blocked: {"local_blocklist"}, "203.0.113.9": {"local_blocklist"}}
+    if err := writeBlocklistFile(whitelist, blocklist, path); err != nil {
+      t.Fatalf("writeBlocklistFile: %v", err)
+    }
+    if err := writeWhitelistFile(whitelist, whitelistPath); err != nil {
+      t.Fatalf("writeWhitelistFile: %v", err)
+    }
+  }
+  write("192.0.2.1")
+  previous, _ := os.ReadFile(path)
+  previousWhitelist, _ := os.ReadFile(whitelistPath)
+  write("198.51.100.1")
+
+  if err := rollbackNginxFiles(path); err != nil {
+    t.Fatalf("rollbackNginxFiles: %v", err)
+  }
+
+  restored, _ := os.ReadFile(path)
+  if string(restored) != string(previous) {
+    t.Errorf("blocklist.conf not restored:\n%s\nwant:\n%s", restored, previous)
+  }
+  restoredWhitelist, _ := os.ReadFile(whitelistPath)
+  if string(restoredWhitelist) != string(previousWhitelist) {
+    t.Errorf("whitelist.conf not restored:\n%s\nwant:\n%s", restoredWhitelist, previousWhitelist)
+  }
+  if _, err := verifyChecksumFile(path); err != nil {
+    t.Errorf("checksum sidecar should match the restored file: %v", err)
+  }
+}
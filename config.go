@@ -13,6 +13,104 @@ type Config struct {
 	RemoteBlocklists    []string `json:"remote_blocklists"`
 	ConfFilePath        string   `json:"nginx_conf_file_path"`
 	NginxContainerNames []string `json:"nginx_container_names"`
+
+	// ApacheContainerNames are sent SIGUSR1 (graceful restart) after each update.
+	ApacheContainerNames []string `json:"apache_container_names"`
+	// SwarmServices are Docker Swarm services force-updated after each update, so Swarm rolls
+	// their tasks.
+	SwarmServices []string `json:"swarm_services"`
+	// Kubernetes publishes the nginx files in a ConfigMap and rolls Deployments mounting it.
+	Kubernetes *KubernetesConfig `json:"kubernetes"`
+	// NginxKeyval pushes the entries into an NGINX Plus keyval zone (or an OpenResty endpoint
+	// with the same contract) instead of reloading nginx.
+	NginxKeyval *KeyvalConfig `json:"nginx_keyval"`
+	// PostApplyHooks run after each write of new nginx files, before the other reload targets.
+	PostApplyHooks []HookConfig `json:"post_apply_hooks"`
+	// Outputs are additional renderings of the carved blocklist.
+	Outputs []OutputConfig `json:"outputs"`
+	// SourceOptions holds optional per-source settings, keyed by the blocklist URL
+	// (or "local_blocklist" for the inline list).
+	SourceOptions map[string]SourceOptions `json:"source_options"`
+	// NginxGeoLayout is "single" (default, one geo block) or "per_source" (one include file per
+	// source under etr.d/, pulled into the geo block by blocklist.conf).
+	NginxGeoLayout string `json:"nginx_geo_layout"`
+	// NginxGeoTemplate is a Go text/template file laying out the geo $blocked_source block
+	// (see geoTemplateData). The built-in layout is used when empty.
+	NginxGeoTemplate string `json:"nginx_geo_template"`
+	// NginxIncludeDir is the etr.d directory as nginx sees it (default /etc/nginx/conf.d/etr.d).
+	NginxIncludeDir string `json:"nginx_include_dir"`
+	// NginxContainerLabels selects additional nginx containers by Docker label filters
+	// ("key" or "key=value"); a running container must match all of them.
+	NginxContainerLabels []string `json:"nginx_container_labels"`
+	// NginxExpectedContainers, if set, is how many containers the label filters must match.
+	NginxExpectedContainers int `json:"nginx_expected_containers"`
+	// NginxHistorySize is how many generations of the nginx files to keep for the rollback
+	// command (default 7; negative disables the history).
+	NginxHistorySize int `json:"nginx_history_size"`
+	// NginxReloadStrategy is how nginx containers pick up a new list: "restart" (default),
+	// "signal" (SIGHUP) or "exec" (nginx -s reload). Graceful strategies fall back to restart.
+	NginxReloadStrategy string `json:"nginx_reload_strategy"`
+	// NginxReloadStrategies overrides NginxReloadStrategy per container name.
+	NginxReloadStrategies map[string]string `json:"nginx_reload_strategies"`
+	// NginxTestImage runs nginx -t in a throwaway container when there is no nginx container to
+	// test in but Swarm services or Kubernetes load the files (default nginx:alpine).
+	NginxTestImage string `json:"nginx_test_image"`
+	// NginxHealthProbe decides when a reloaded container is back before the next one is
+	// reloaded: "docker" (default, Docker's health status), "tcp" or "http" (GET /check_ip).
+	NginxHealthProbe string `json:"nginx_health_probe"`
+	// NginxHealthPort is the port probed by "tcp" and "http" (default 80).
+	NginxHealthPort int `json:"nginx_health_port"`
+	// NginxHealthTimeout is how long to wait for each container, in seconds (default 60).
+	NginxHealthTimeout int `json:"nginx_health_timeout"`
+	// NginxStoppedContainers is what to do with a target that is not running: "start"
+	// (default, reload it anyway), "skip" or "fail".
+	NginxStoppedContainers string `json:"nginx_stopped_containers"`
+}
+
+// SourceOptions are optional settings for one blocklist source.
+type SourceOptions struct {
+	// Weight expresses confidence in the source; outputs that carry a score use it (e.g. suricata).
+	Weight int `json:"weight,omitempty"`
+	// Format is "plain" (IPs/CIDRs anywhere in the text) or "rules" (Suricata/Snort rule
+	// headers). When empty, sources whose path ends in ".rules" are parsed as rules.
+	Format string `json:"format,omitempty"`
+	// RuleSide selects the address field read from rules: "src" (default), "dst" or "both".
+	RuleSide string `json:"rule_side,omitempty"`
+	// Tier is the severity tier nginx should apply to matches: "block" (default),
+	// "challenge" or "ratelimit". See renderTierMap.
+	Tier string `json:"tier,omitempty"`
+	// Mode is "enforce" (default) or "shadow": shadow matches only set $etr_shadow_source
+	// until the source is promoted (see applyShadowMode).
+	Mode string `json:"mode,omitempty"`
+	// PromoteOn (YYYY-MM-DD) promotes a shadow source to enforcing on that date.
+	PromoteOn string `json:"promote_on,omitempty"`
+	// PromoteAfterCleanDays promotes a shadow source after this many days without listing a
+	// whitelisted address.
+	PromoteAfterCleanDays int `json:"promote_after_clean_days,omitempty"`
+}
+
+// OutputConfig describes one additional rendering of the carved blocklist, written alongside
+// the nginx geo file. See outputFormats for the supported formats.
+type OutputConfig struct {
+	Format string `json:"format"`
+	Path   string `json:"path"`
+	// Name is the table/set name used by formats that need one (default "etr").
+	Name string `json:"name,omitempty"`
+	// Mode selects a variant of the format, e.g. "client_ip" for caddy or "allowlist" for traefik.
+	Mode string `json:"mode,omitempty"`
+	// Score overrides per-source weights for formats that carry a score (e.g. suricata).
+	Score int `json:"score,omitempty"`
+	// MaxEntries caps the CIDRs per generated object for formats that split large lists
+	// (calico, cilium, networkpolicy).
+	MaxEntries int `json:"max_entries,omitempty"`
+	// SkipWideNetworks lets the apache rewritemap mode leave out networks too wide to list
+	// address by address instead of failing; the skipped count is sent as a notification.
+	SkipWideNetworks bool `json:"skip_wide_networks,omitempty"`
+	// Template is the Go text/template file rendered by the "template" format.
+	Template string `json:"template,omitempty"`
+	// PostWriteCommand is an optional argv (no shell) run after the file is written,
+	// e.g. ["nft", "-f", "/app/nginx/conf/etr.nft"].
+	PostWriteCommand []string `json:"post_write_command,omitempty"`
 }
 
 // readConfig reads the configuration from a JSON file
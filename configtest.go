@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/mount"
+	"github.com/moby/moby/client"
+)
+
+// defaultNginxTestImage runs nginx -t when no nginx container can run it.
+const defaultNginxTestImage = "nginx:alpine"
+
+// nginxTestTimeout bounds a throwaway config test, including pulling its image.
+const nginxTestTimeout = 2 * time.Minute
+
+// dockerEnvPath exists inside Docker containers. Declared as a var so tests can override it.
+var dockerEnvPath = "/.dockerenv"
+
+// nginxTestAPI is the subset of the Docker client used to config-test the nginx files before
+// any reload target sees them. *client.Client satisfies it; tests substitute a fake.
+type nginxTestAPI interface {
+	containerAPI
+	ContainerCreate(ctx context.Context, options client.ContainerCreateOptions) (client.ContainerCreateResult, error)
+	ContainerStart(ctx context.Context, containerID string, options client.ContainerStartOptions) (client.ContainerStartResult, error)
+	ContainerWait(ctx context.Context, containerID string, options client.ContainerWaitOptions) client.ContainerWaitResult
+	ContainerLogs(ctx context.Context, containerID string, options client.ContainerLogsOptions) (client.ContainerLogsResult, error)
+	ContainerRemove(ctx context.Context, containerID string, options client.ContainerRemoveOptions) (client.ContainerRemoveResult, error)
+	ImagePull(ctx context.Context, refStr string, options client.ImagePullOptions) (client.ImagePullResponse, error)
+}
+
+// testNginxConfig runs nginx -t against the files just written, before any reload target is
+// touched: in the nginx containers, or, when there are none but Swarm services or Kubernetes
+// will load the files, in a throwaway container. It returns an error only when nginx rejects the
+// files; a test that cannot run at all is logged and skipped, as in validateNginxConfigs.
+func testNginxConfig(cli nginxTestAPI, config *Config, nginxContainers []string) error {
+	if len(nginxContainers) > 0 {
+		return validateNginxConfigs(cli, nginxContainers)
+	}
+	if len(config.SwarmServices) == 0 && config.Kubernetes == nil {
+		return nil
+	}
+
+	image := config.NginxTestImage
+	if image == "" {
+		image = defaultNginxTestImage
+	}
+	output, err := runNginxTestContainer(cli, image, config.ConfFilePath, config.NginxIncludeDir)
+	var exitErr *execExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("nginx -t failed in a throwaway %s container:\n%s", image, exitErr.output)
+	}
+	if err != nil {
+		logf("Skipping the config test in a throwaway %s container: %v\n", image, err)
+		return nil
+	}
+	logf("Config test passed in a throwaway %s container.%s\n", image, formatExecOutput(output))
+	return nil
+}
+
+// runNginxTestContainer runs `nginx -t` in a new container of image, with the directory holding
+// blocklist.conf mounted read-only where nginx sees it (the parent of nginx_include_dir, by
+// default /etc/nginx/conf.d), and removes the container afterwards. The image is pulled if the
+// daemon does not have it. Like execInContainer, it returns an *execExitError when nginx exits
+// non-zero.
+func runNginxTestContainer(cli nginxTestAPI, image, confFilePath, nginxIncludeDir string) (string, error) {
+	if nginxIncludeDir == "" {
+		nginxIncludeDir = defaultNginxIncludeDir
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nginxTestTimeout)
+	defer cancel()
+
+	confMount, err := nginxConfMount(ctx, cli, filepath.Dir(confFilePath), path.Dir(nginxIncludeDir))
+	if err != nil {
+		return "", err
+	}
+	options := client.ContainerCreateOptions{
+		Config: &container.Config{
+			Image:  image,
+			Cmd:    []string{"nginx", "-t"},
+			Labels: map[string]string{"etr.config-test": "true"},
+		},
+		HostConfig: &container.HostConfig{
+			Mounts:      []mount.Mount{confMount},
+			NetworkMode: "none",
+		},
+	}
+	created, err := cli.ContainerCreate(ctx, options)
+	if cerrdefs.IsNotFound(err) {
+		if err := pullImage(ctx, cli, image); err != nil {
+			return "", fmt.Errorf("failed to pull %s: %v", image, err)
+		}
+		created, err = cli.ContainerCreate(ctx, options)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create config test container: %v", err)
+	}
+	defer func() {
+		// Runs even when ctx expired, so the container is not left behind.
+		removeCtx, removeCancel := context.WithTimeout(context.Background(), dockerOpTimeout)
+		defer removeCancel()
+		if _, err := cli.ContainerRemove(removeCtx, created.ID, client.ContainerRemoveOptions{Force: true}); err != nil {
+			logf("Failed to remove config test container %s: %v\n", created.ID, err)
+		}
+	}()
+
+	waited := cli.ContainerWait(ctx, created.ID, client.ContainerWaitOptions{Condition: container.WaitConditionNextExit})
+	if _, err := cli.ContainerStart(ctx, created.ID, client.ContainerStartOptions{}); err != nil {
+		return "", fmt.Errorf("failed to start config test container: %v", err)
+	}
+	var code int64
+	select {
+	case res := <-waited.Result:
+		if res.Error != nil {
+			return "", fmt.Errorf("config test container failed: %s", res.Error.Message)
+		}
+		code = res.StatusCode
+	case err := <-waited.Error:
+		return "", fmt.Errorf("failed to wait for config test container: %v", err)
+	}
+
+	logs, err := cli.ContainerLogs(ctx, created.ID, client.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return "", fmt.Errorf("failed to read config test output: %v", err)
+	}
+	defer logs.Close()
+	// Without a TTY, stdout and stderr arrive multiplexed; nginx writes its messages to stderr.
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, logs); err != nil {
+		return "", fmt.Errorf("failed to read config test output: %v", err)
+	}
+	text := strings.TrimSpace(output.String())
+	if code != 0 {
+		return text, &execExitError{cmd: "nginx -t", container: image, code: int(code), output: text}
+	}
+	return text, nil
+}
+
+// pullImage pulls image and waits for the pull to finish.
+func pullImage(ctx context.Context, cli nginxTestAPI, image string) error {
+	pulled, err := cli.ImagePull(ctx, image, client.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer pulled.Close()
+	return pulled.Wait(ctx)
+}
+
+// nginxConfMount mounts confDir at target in the test container. The daemon resolves mount
+// sources on the host, so when the generator itself runs in a container (the usual deployment),
+// confDir is mapped back to the volume or host directory mounted there; otherwise it is bind
+// mounted as is.
+func nginxConfMount(ctx context.Context, cli nginxTestAPI, confDir, target string) (mount.Mount, error) {
+	if _, err := os.Stat(dockerEnvPath); err != nil {
+		return mount.Mount{Type: mount.TypeBind, Source: confDir, Target: target, ReadOnly: true}, nil
+	}
+
+	// Docker sets the hostname to the short container ID unless the compose file overrides it.
+	self, err := os.Hostname()
+	if err != nil {
+		return mount.Mount{}, err
+	}
+	inspectCtx, cancel := context.WithTimeout(ctx, dockerOpTimeout)
+	inspected, err := cli.ContainerInspect(inspectCtx, self, client.ContainerInspectOptions{})
+	cancel()
+	if err != nil {
+		return mount.Mount{}, fmt.Errorf("failed to inspect the generator's own container %s: %v", self, err)
+	}
+
+	var best *container.MountPoint
+	var bestRel string
+	for i, m := range inspected.Container.Mounts {
+		rel, err := filepath.Rel(m.Destination, confDir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if best == nil || len(m.Destination) > len(best.Destination) {
+			best, bestRel = &inspected.Container.Mounts[i], rel
+		}
+	}
+	if best == nil {
+		return mount.Mount{}, fmt.Errorf("%s is not on a volume or bind mount of container %s", confDir, self)
+	}
+
+	switch best.Type {
+	case mount.TypeVolume:
+		m := mount.Mount{Type: mount.TypeVolume, Source: best.Name, Target: target, ReadOnly: true}
+		if bestRel != "." {
+			m.VolumeOptions = &mount.VolumeOptions{Subpath: bestRel}
+		}
+		return m, nil
+	case mount.TypeBind:
+		return mount.Mount{Type: mount.TypeBind, Source: filepath.Join(best.Source, bestRel), Target: target, ReadOnly: true}, nil
+	}
+	return mount.Mount{}, fmt.Errorf("%s is on a %s mount, which cannot be shared with the config test container", confDir, best.Type)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/jsonstream"
+	"github.com/moby/moby/api/types/mount"
+	"github.com/moby/moby/client"
+)
+
+func (f *fakeDocker) ContainerCreate(_ context.Context, options client.ContainerCreateOptions) (client.ContainerCreateResult, error) {
+	if f.missingImage {
+		return client.ContainerCreateResult{}, cerrdefs.ErrNotFound.WithMessage("No such image: " + options.Config.Image)
+	}
+	f.created = append(f.created, options)
+	return client.ContainerCreateResult{ID: fmt.Sprintf("test-%d", len(f.created))}, nil
+}
+
+func (f *fakeDocker) ContainerStart(_ context.Context, containerID string, _ client.ContainerStartOptions) (client.ContainerStartResult, error) {
+	return client.ContainerStartResult{}, f.errors["start_"+containerID]
+}
+
+func (f *fakeDocker) ContainerWait(_ context.Context, _ string, _ client.ContainerWaitOptions) client.ContainerWaitResult {
+	result := make(chan container.WaitResponse, 1)
+	result <- container.WaitResponse{StatusCode: int64(f.testResult.exitCode)}
+	return client.ContainerWaitResult{Result: result, Error: make(chan error)}
+}
+
+// ContainerLogs streams the scripted output on stderr using Docker's multiplexed framing.
+func (f *fakeDocker) ContainerLogs(_ context.Context, _ string, _ client.ContainerLogsOptions) (client.ContainerLogsResult, error) {
+	var frame []byte
+	if output := f.testResult.output; output != "" {
+		frame = make([]byte, 8, 8+len(output))
+		frame[0] = byte(stdcopy.Stderr)
+		binary.BigEndian.PutUint32(frame[4:], uint32(len(output)))
+		frame = append(frame, output...)
+	}
+	return io.NopCloser(strings.NewReader(string(frame))), nil
+}
+
+func (f *fakeDocker) ContainerRemove(_ context.Context, containerID string, _ client.ContainerRemoveOptions) (client.ContainerRemoveResult, error) {
+	f.removed = append(f.removed, containerID)
+	return client.ContainerRemoveResult{}, nil
+}
+
+func (f *fakeDocker) ImagePull(_ context.Context, refStr string, _ client.ImagePullOptions) (client.ImagePullResponse, error) {
+	f.pulls = append(f.pulls, refStr)
+	f.missingImage = false
+	return fakePull{io.NopCloser(strings.NewReader(""))}, nil
+}
+
+type fakePull struct{ io.ReadCloser }
+
+func (fakePull) JSONMessages(context.Context) iter.Seq2[jsonstream.Message, error] {
+	return func(func(jsonstream.Message, error) bool) {}
+}
+
+func (fakePull) Wait(context.Context) error { return nil }
+
+// outsideDocker makes nginxConfMount bind mount the conf directory as is.
+func outsideDocker(t *testing.T) {
+	previous := dockerEnvPath
+	dockerEnvPath = filepath.Join(t.TempDir(), "missing")
+	t.Cleanup(func() { dockerEnvPath = previous })
+}
+
+func TestTestNginxConfigInThrowawayContainer(t *testing.T) {
+	outsideDocker(t)
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	config := &Config{ConfFilePath: confPath, SwarmServices: []string{"etr_nginx"}}
+
+	fake := &fakeDocker{missingImage: true}
+	if err := testNginxConfig(fake, config, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(fake.pulls) != "[nginx:alpine]" {
+		t.Errorf("pulls = %v, want the default image pulled once", fake.pulls)
+	}
+	if len(fake.created) != 1 {
+		t.Fatalf("created %d containers, want 1", len(fake.created))
+	}
+	created := fake.created[0]
+	if got := strings.Join(created.Config.Cmd, " "); got != "nginx -t" {
+		t.Errorf("cmd = %q", got)
+	}
+	want := mount.Mount{Type: mount.TypeBind, Source: filepath.Dir(confPath), Target: "/etc/nginx/conf.d", ReadOnly: true}
+	if len(created.HostConfig.Mounts) != 1 || created.HostConfig.Mounts[0] != want {
+		t.Errorf("mounts = %+v, want %+v", created.HostConfig.Mounts, want)
+	}
+	if fmt.Sprint(fake.removed) != "[test-1]" {
+		t.Errorf("removed = %v, want the test container removed", fake.removed)
+	}
+
+	rejected := &fakeDocker{testResult: fakeExecResult{output: "nginx: [emerg] unexpected \"}\" in blocklist.conf:12", exitCode: 1}}
+	err := testNginxConfig(rejected, config, nil)
+	if err == nil || !strings.Contains(err.Error(), "unexpected \"}\"") {
+		t.Fatalf("expected nginx's output in the error, got %v", err)
+	}
+	if len(rejected.removed) != 1 {
+		t.Errorf("a rejected test should still remove its container, removed = %v", rejected.removed)
+	}
+}
+
+func TestTestNginxConfigPrefersNginxContainers(t *testing.T) {
+	fake := &fakeDocker{}
+	config := &Config{ConfFilePath: filepath.Join(t.TempDir(), "blocklist.conf"), Kubernetes: &KubernetesConfig{}}
+	if err := testNginxConfig(fake, config, []string{"nginx1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(fake.execs) != "[nginx1:nginx -t]" || len(fake.created) != 0 {
+		t.Errorf("execs = %v, created = %d; want nginx -t in nginx1 only", fake.execs, len(fake.created))
+	}
+
+	// Nothing loads the files without nginx containers, Swarm or Kubernetes.
+	if err := testNginxConfig(fake, &Config{}, nil); err != nil || len(fake.created) != 0 {
+		t.Errorf("unexpected test container: %v, %d", err, len(fake.created))
+	}
+}
+
+func TestNginxConfMountInsideContainer(t *testing.T) {
+	dockerEnv := filepath.Join(t.TempDir(), ".dockerenv")
+	if err := os.WriteFile(dockerEnv, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	previous := dockerEnvPath
+	dockerEnvPath = dockerEnv
+	t.Cleanup(func() { dockerEnvPath = previous })
+	self, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeDocker{mounts: map[string][]container.MountPoint{self: {
+		{Type: mount.TypeVolume, Name: "etr_nginx-blocking-rules", Destination: "/app/nginx/conf"},
+		{Type: mount.TypeBind, Source: "/srv/etr/config.json", Destination: "/app/config.json"},
+	}}}
+	got, err := nginxConfMount(context.Background(), fake, "/app/nginx/conf", "/etc/nginx/conf.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mount.Mount{Type: mount.TypeVolume, Source: "etr_nginx-blocking-rules", Target: "/etc/nginx/conf.d", ReadOnly: true}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("mount = %+v, want %+v", got, want)
+	}
+
+	got, err = nginxConfMount(context.Background(), fake, "/app/nginx/conf/edge", "/etc/nginx/conf.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VolumeOptions == nil || got.VolumeOptions.Subpath != "edge" {
+		t.Errorf("a subdirectory should be mounted as a volume subpath, got %+v", got)
+	}
+
+	if _, err := nginxConfMount(context.Background(), fake, "/tmp/etr", "/etc/nginx/conf.d"); err == nil {
+		t.Error("expected an error for a directory on no mount")
+	}
+}
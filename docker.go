@@ -1,17 +1,231 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
+	"github.com/moby/moby/api/pkg/stdcopy"
 	"github.com/moby/moby/client"
 )
 
+// Ways an nginx container can pick up a new blocklist, selected by nginx_reload_strategy.
+const (
+	reloadRestart = "restart" // ContainerRestart: drops in-flight requests while nginx is down
+	reloadSignal  = "signal"  // SIGHUP via ContainerKill: workers roll over gracefully
+	reloadExec    = "exec"    // `nginx -s reload` via the exec API: same, reported by nginx itself
+)
+
+// containerAPI is the subset of the Docker client used to apply a new blocklist.
+// *client.Client satisfies it; tests substitute a fake.
+type containerAPI interface {
+	ContainerRestart(ctx context.Context, containerID string, options client.ContainerRestartOptions) (client.ContainerRestartResult, error)
+	ContainerKill(ctx context.Context, containerID string, options client.ContainerKillOptions) (client.ContainerKillResult, error)
+	ContainerList(ctx context.Context, options client.ContainerListOptions) (client.ContainerListResult, error)
+	ContainerInspect(ctx context.Context, containerID string, options client.ContainerInspectOptions) (client.ContainerInspectResult, error)
+	ExecCreate(ctx context.Context, containerID string, options client.ExecCreateOptions) (client.ExecCreateResult, error)
+	ExecAttach(ctx context.Context, execID string, options client.ExecAttachOptions) (client.ExecAttachResult, error)
+	ExecInspect(ctx context.Context, execID string, options client.ExecInspectOptions) (client.ExecInspectResult, error)
+}
+
+// validateContainerLabels checks nginx_container_labels: each filter is "key" or "key=value".
+func validateContainerLabels(labels []string, expected int) error {
+	for _, label := range labels {
+		if key, _, _ := strings.Cut(label, "="); strings.TrimSpace(key) == "" {
+			return fmt.Errorf("label filter %q has no key (want key or key=value)", label)
+		}
+	}
+	if expected < 0 {
+		return fmt.Errorf("nginx_expected_containers must not be negative, got %d", expected)
+	}
+	if expected > 0 && len(labels) == 0 {
+		return fmt.Errorf("nginx_expected_containers is set but nginx_container_labels is empty")
+	}
+	return nil
+}
+
+// resolveNginxContainers returns the containers to reload: the configured names plus every
+// running container matching all label filters, sorted and without duplicates. Compose replicas
+// and Swarm tasks get generated names, so labels are the stable way to find them. When expected
+// is set, any other number of label matches is an error, so a typo in a filter cannot silently
+// leave replicas on the old list — or reload unrelated containers.
+func resolveNginxContainers(cli containerAPI, names, labels []string, expected int) ([]string, error) {
+	targets := make(map[string]bool, len(names))
+	for _, name := range names {
+		targets[name] = true
+	}
+
+	if len(labels) > 0 {
+		filters := make(client.Filters).Add("label", labels...)
+		ctx, cancel := context.WithTimeout(context.Background(), dockerOpTimeout)
+		listed, err := cli.ContainerList(ctx, client.ContainerListOptions{Filters: filters})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list containers labelled %s: %v", strings.Join(labels, ", "), err)
+		}
+
+		var matched []string
+		for _, c := range listed.Items {
+			if len(c.Names) == 0 {
+				continue
+			}
+			// The API reports names with a leading slash.
+			name := strings.TrimPrefix(c.Names[0], "/")
+			if err := validateContainerName(name); err != nil {
+				return nil, fmt.Errorf("invalid container name: %v", err)
+			}
+			matched = append(matched, name)
+			targets[name] = true
+		}
+		sort.Strings(matched)
+		if expected > 0 && len(matched) != expected {
+			return nil, fmt.Errorf("expected %d container(s) labelled %s, found %d: %s",
+				expected, strings.Join(labels, ", "), len(matched), strings.Join(matched, ", "))
+		}
+		logf("Found %d container(s) labelled %s: %s\n", len(matched), strings.Join(labels, ", "), strings.Join(matched, ", "))
+	}
+
+	resolved := make([]string, 0, len(targets))
+	for name := range targets {
+		resolved = append(resolved, name)
+	}
+	sort.Strings(resolved)
+	return resolved, nil
+}
+
+// validateReloadStrategies checks the default strategy and every per-container override.
+func validateReloadStrategies(defaultStrategy string, overrides map[string]string) error {
+	check := func(strategy string) error {
+		switch strategy {
+		case "", reloadRestart, reloadSignal, reloadExec:
+			return nil
+		}
+		return fmt.Errorf("unknown reload strategy %q (want restart, signal or exec)", strategy)
+	}
+	if err := check(defaultStrategy); err != nil {
+		return err
+	}
+	for name, strategy := range overrides {
+		if err := check(strategy); err != nil {
+			return fmt.Errorf("container %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// reloadNginxContainer applies the new blocklist to one container. A graceful strategy that
+// fails falls back to a restart so the container never keeps serving a stale list.
+func reloadNginxContainer(cli containerAPI, containerName, strategy string) error {
+	var err error
+	switch strategy {
+	case reloadSignal:
+		err = signalContainers(cli, []string{containerName}, "SIGHUP")
+	case reloadExec:
+		var output string
+		output, err = execInContainer(cli, containerName, []string{"nginx", "-s", "reload"})
+		if err == nil {
+			logf("Reloaded nginx in container %s.%s\n", containerName, formatExecOutput(output))
+		}
+	default:
+		return restartNginxContainers(cli, []string{containerName})
+	}
+	if err != nil {
+		logf("Graceful %s reload of %s failed, falling back to restart: %v\n", strategy, containerName, err)
+		return restartNginxContainers(cli, []string{containerName})
+	}
+	return nil
+}
+
+// execInContainer runs cmd in the container and returns its combined stdout/stderr.
+// A non-zero exit code is reported as an error that includes the output.
+func execInContainer(cli containerAPI, containerName string, cmd []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerOpTimeout)
+	defer cancel()
+
+	created, err := cli.ExecCreate(ctx, containerName, client.ExecCreateOptions{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create exec %q in container %s: %v", strings.Join(cmd, " "), containerName, err)
+	}
+	attached, err := cli.ExecAttach(ctx, created.ID, client.ExecAttachOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to start exec %q in container %s: %v", strings.Join(cmd, " "), containerName, err)
+	}
+	defer attached.Close()
+
+	// Without a TTY, stdout and stderr arrive multiplexed; nginx writes its messages to stderr.
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, attached.Reader); err != nil {
+		return "", fmt.Errorf("failed to read exec output from container %s: %v", containerName, err)
+	}
+
+	inspected, err := cli.ExecInspect(ctx, created.ID, client.ExecInspectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect exec in container %s: %v", containerName, err)
+	}
+	text := strings.TrimSpace(output.String())
+	if inspected.ExitCode != 0 {
+		return text, &execExitError{cmd: strings.Join(cmd, " "), container: containerName, code: inspected.ExitCode, output: text}
+	}
+	return text, nil
+}
+
+// execExitError reports a command that ran in a container but exited non-zero, as opposed to
+// an exec that could not be run at all.
+type execExitError struct {
+	cmd       string
+	container string
+	code      int
+	output    string
+}
+
+func (e *execExitError) Error() string {
+	return fmt.Sprintf("%q exited with status %d in container %s: %s", e.cmd, e.code, e.container, e.output)
+}
+
+// validateNginxConfigs runs `nginx -t` in each container against the files just written and
+// returns an error carrying nginx's output for the first container that rejects them.
+// A container where the test cannot run at all (e.g. it is stopped) is logged and skipped:
+// only nginx's own verdict triggers a rollback.
+func validateNginxConfigs(cli containerAPI, containerNames []string) error {
+	for _, containerName := range containerNames {
+		if err := validateContainerName(containerName); err != nil {
+			return fmt.Errorf("invalid container name: %v", err)
+		}
+
+		output, err := execInContainer(cli, containerName, []string{"nginx", "-t"})
+		var exitErr *execExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("nginx -t failed in container %s:\n%s", containerName, exitErr.output)
+		}
+		if err != nil {
+			logf("Skipping config test in container %s: %v\n", containerName, err)
+			continue
+		}
+		logf("Config test passed in container %s.%s\n", containerName, formatExecOutput(output))
+	}
+	return nil
+}
+
+// formatExecOutput renders command output as a log-line suffix, or nothing if it is empty.
+func formatExecOutput(output string) string {
+	if output == "" {
+		return ""
+	}
+	return " Output: " + output
+}
+
 // restartNginxContainers restarts specified Docker containers.
 // Container names are validated before use and each Docker API call has a hard timeout.
 // ContainerRestart is used as a single atomic call so the container is never left stopped
 // if the start phase fails.
-func restartNginxContainers(cli *client.Client, containerNames []string) error {
+func restartNginxContainers(cli containerAPI, containerNames []string) error {
 	for _, containerName := range containerNames {
 		if err := validateContainerName(containerName); err != nil {
 			return fmt.Errorf("invalid container name: %v", err)
@@ -21,7 +235,7 @@ func restartNginxContainers(cli *client.Client, containerNames []string) error {
 		_, err := cli.ContainerRestart(ctx, containerName, client.ContainerRestartOptions{})
 		cancel()
 		if err != nil {
-			return fmt.Errorf("failed to restart container %s: %v", containerName, err)
+			return fmt.Errorf("failed to restart container %s: %w", containerName, err)
 		}
 
 		logf("Container %s restarted successfully.\n", containerName)
@@ -29,3 +243,30 @@ func restartNginxContainers(cli *client.Client, containerNames []string) error {
 
 	return nil
 }
+
+// reloadApacheContainers sends SIGUSR1 to each Apache httpd container, which makes httpd
+// re-read its configuration and replace its children gracefully, finishing in-flight requests.
+func reloadApacheContainers(cli containerAPI, containerNames []string) error {
+	return signalContainers(cli, containerNames, "SIGUSR1")
+}
+
+// signalContainers sends signal to each named container via ContainerKill.
+// Names are validated before use and each Docker API call has a hard timeout.
+func signalContainers(cli containerAPI, containerNames []string, signal string) error {
+	for _, containerName := range containerNames {
+		if err := validateContainerName(containerName); err != nil {
+			return fmt.Errorf("invalid container name: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), dockerOpTimeout)
+		_, err := cli.ContainerKill(ctx, containerName, client.ContainerKillOptions{Signal: signal})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to send %s to container %s: %w", signal, containerName, err)
+		}
+
+		logf("Sent %s to container %s.\n", signal, containerName)
+	}
+
+	return nil
+}
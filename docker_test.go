@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/client"
+)
+
+// fakeDocker records the calls made through containerAPI.
+type fakeDocker struct {
+	restarts []string
+	signals  []string // "<container>:<signal>"
+	execs    []string // "<container>:<cmd>"
+	errors   map[string]error
+
+	// containers is what ContainerList filters; only running ones are listed, as by the daemon.
+	containers []container.Summary
+	// states scripts ContainerInspect per container, one state per call (the last one repeats);
+	// unscripted containers are running without a healthcheck.
+	states    map[string][]container.State
+	addresses map[string]string
+	inspects  map[string]int
+	// execResults scripts exec results per "<container>:<cmd>"; unscripted commands succeed silently.
+	execResults map[string]fakeExecResult
+	pending     map[string]fakeExecResult // exec ID → result
+
+	// mounts are reported by ContainerInspect per container.
+	mounts map[string][]container.MountPoint
+	// Throwaway config test containers: testResult scripts their exit, and the image is only
+	// available after a pull when missingImage is set.
+	testResult   fakeExecResult
+	missingImage bool
+	created      []client.ContainerCreateOptions
+	removed      []string
+	pulls        []string
+}
+
+type fakeExecResult struct {
+	output   string
+	exitCode int
+}
+
+func (f *fakeDocker) ContainerRestart(_ context.Context, containerID string, _ client.ContainerRestartOptions) (client.ContainerRestartResult, error) {
+	f.restarts = append(f.restarts, containerID)
+	return client.ContainerRestartResult{}, f.errors["restart_"+containerID]
+}
+
+func (f *fakeDocker) ContainerKill(_ context.Context, containerID string, options client.ContainerKillOptions) (client.ContainerKillResult, error) {
+	f.signals = append(f.signals, containerID+":"+options.Signal)
+	return client.ContainerKillResult{}, f.errors["kill_"+containerID]
+}
+
+// ContainerList applies label filters with the daemon's semantics: every filter must match.
+func (f *fakeDocker) ContainerList(_ context.Context, options client.ContainerListOptions) (client.ContainerListResult, error) {
+	if err := f.errors["list"]; err != nil {
+		return client.ContainerListResult{}, err
+	}
+	var items []container.Summary
+	for _, c := range f.containers {
+		if c.State != container.StateRunning && !options.All {
+			continue
+		}
+		matches := true
+		for filter := range options.Filters["label"] {
+			key, value, hasValue := strings.Cut(filter, "=")
+			got, ok := c.Labels[key]
+			if !ok || (hasValue && got != value) {
+				matches = false
+			}
+		}
+		if matches {
+			items = append(items, c)
+		}
+	}
+	return client.ContainerListResult{Items: items}, nil
+}
+
+func (f *fakeDocker) ContainerInspect(_ context.Context, containerID string, _ client.ContainerInspectOptions) (client.ContainerInspectResult, error) {
+	if err := f.errors["inspect_"+containerID]; err != nil {
+		return client.ContainerInspectResult{}, err
+	}
+	if f.inspects == nil {
+		f.inspects = make(map[string]int)
+	}
+	state := container.State{Status: container.StateRunning, Running: true}
+	if states := f.states[containerID]; len(states) > 0 {
+		state = states[min(f.inspects[containerID], len(states)-1)]
+	}
+	f.inspects[containerID]++
+
+	inspected := container.InspectResponse{State: &state, Mounts: f.mounts[containerID]}
+	if addr, ok := f.addresses[containerID]; ok {
+		inspected.NetworkSettings = &container.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"etr": {IPAddress: netip.MustParseAddr(addr)},
+		}}
+	}
+	return client.ContainerInspectResult{Container: inspected}, nil
+}
+
+func (f *fakeDocker) ExecCreate(_ context.Context, containerID string, options client.ExecCreateOptions) (client.ExecCreateResult, error) {
+	key := containerID + ":" + strings.Join(options.Cmd, " ")
+	f.execs = append(f.execs, key)
+	if err := f.errors["exec_"+containerID]; err != nil {
+		return client.ExecCreateResult{}, err
+	}
+	if f.pending == nil {
+		f.pending = make(map[string]fakeExecResult)
+	}
+	id := fmt.Sprintf("exec-%d", len(f.execs))
+	f.pending[id] = f.execResults[key]
+	return client.ExecCreateResult{ID: id}, nil
+}
+
+// ExecAttach streams the scripted output on stderr using Docker's multiplexed framing.
+func (f *fakeDocker) ExecAttach(_ context.Context, execID string, _ client.ExecAttachOptions) (client.ExecAttachResult, error) {
+	conn, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		output := f.pending[execID].output
+		if output == "" {
+			return
+		}
+		header := make([]byte, 8)
+		header[0] = byte(stdcopy.Stderr)
+		binary.BigEndian.PutUint32(header[4:], uint32(len(output)))
+		server.Write(append(header, output...))
+	}()
+	return client.ExecAttachResult{HijackedResponse: client.NewHijackedResponse(conn, "")}, nil
+}
+
+func (f *fakeDocker) ExecInspect(_ context.Context, execID string, _ client.ExecInspectOptions) (client.ExecInspectResult, error) {
+	return client.ExecInspectResult{ID: execID, ExitCode: f.pending[execID].exitCode}, nil
+}
+
+func TestRestartNginxContainersUsesContainerAPI(t *testing.T) {
+	fake := &fakeDocker{}
+	if err := restartNginxContainers(fake, []string{"nginx1", "nginx2"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(fake.restarts) != "[nginx1 nginx2]" {
+		t.Errorf("unexpected restarts: %v", fake.restarts)
+	}
+}
+
+func TestReloadApacheContainers(t *testing.T) {
+	tests := []struct {
+		name        string
+		containers  []string
+		errors      map[string]error
+		expectError bool
+		wantSignals string
+	}{
+		{
+			name:        "graceful restart via SIGUSR1",
+			containers:  []string{"apache1", "apache2"},
+			wantSignals: "[apache1:SIGUSR1 apache2:SIGUSR1]",
+		},
+		{
+			name:        "kill error stops the loop",
+			containers:  []string{"apache1", "apache2"},
+			errors:      map[string]error{"kill_apache1": fmt.Errorf("no such container")},
+			expectError: true,
+			wantSignals: "[apache1:SIGUSR1]",
+		},
+		{
+			name:        "invalid name is rejected before any call",
+			containers:  []string{"apache;rm"},
+			expectError: true,
+			wantSignals: "[]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDocker{errors: tt.errors}
+			err := reloadApacheContainers(fake, tt.containers)
+			if (err != nil) != tt.expectError {
+				t.Errorf("expectError=%v, got %v", tt.expectError, err)
+			}
+			if got := fmt.Sprint(fake.signals); got != tt.wantSignals {
+				t.Errorf("signals = %s, want %s", got, tt.wantSignals)
+			}
+		})
+	}
+}
+
+func TestReloadNginxContainers(t *testing.T) {
+	tests := []struct {
+		name         string
+		strategy     string
+		overrides    map[string]string
+		errors       map[string]error
+		execResults  map[string]fakeExecResult
+		wantRestarts string
+		wantSignals  string
+		wantExecs    string
+	}{
+		{
+			name:         "restart by default",
+			wantRestarts: "[nginx1 nginx2]",
+			wantSignals:  "[]",
+			wantExecs:    "[]",
+		},
+		{
+			name:         "per-container override",
+			strategy:     reloadSignal,
+			overrides:    map[string]string{"nginx2": reloadExec},
+			wantRestarts: "[]",
+			wantSignals:  "[nginx1:SIGHUP]",
+			wantExecs:    "[nginx2:nginx -s reload]",
+		},
+		{
+			name:         "failed signal falls back to restart",
+			strategy:     reloadSignal,
+			errors:       map[string]error{"kill_nginx1": fmt.Errorf("container is paused")},
+			wantRestarts: "[nginx1]",
+			wantSignals:  "[nginx1:SIGHUP nginx2:SIGHUP]",
+			wantExecs:    "[]",
+		},
+		{
+			name:     "non-zero exec exit falls back to restart",
+			strategy: reloadExec,
+			execResults: map[string]fakeExecResult{
+				"nginx2:nginx -s reload": {output: "nginx: [error] invalid PID number", exitCode: 1},
+			},
+			wantRestarts: "[nginx2]",
+			wantSignals:  "[]",
+			wantExecs:    "[nginx1:nginx -s reload nginx2:nginx -s reload]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDocker{errors: tt.errors, execResults: tt.execResults}
+			rollout := nginxRollout{defaultStrategy: tt.strategy, overrides: tt.overrides}
+			if results := rollout.apply(fake, []string{"nginx1", "nginx2"}); results.failures() != 0 {
+				t.Fatalf("unexpected failures:\n%s", results.summary())
+			}
+			if got := fmt.Sprint(fake.restarts); got != tt.wantRestarts {
+				t.Errorf("restarts = %s, want %s", got, tt.wantRestarts)
+			}
+			if got := fmt.Sprint(fake.signals); got != tt.wantSignals {
+				t.Errorf("signals = %s, want %s", got, tt.wantSignals)
+			}
+			if got := fmt.Sprint(fake.execs); got != tt.wantExecs {
+				t.Errorf("execs = %s, want %s", got, tt.wantExecs)
+			}
+		})
+	}
+}
+
+func TestExecInContainerReturnsOutput(t *testing.T) {
+	fake := &fakeDocker{execResults: map[string]fakeExecResult{
+		"nginx1:nginx -t": {output: "nginx: configuration file /etc/nginx/nginx.conf test failed", exitCode: 1},
+	}}
+
+	output, err := execInContainer(fake, "nginx1", []string{"nginx", "-t"})
+	if err == nil {
+		t.Fatal("expected an error for a non-zero exit code")
+	}
+	if !strings.Contains(output, "test failed") || !strings.Contains(err.Error(), "test failed") {
+		t.Errorf("output should be returned and included in the error: output=%q err=%v", output, err)
+	}
+}
+
+func TestValidateReloadStrategies(t *testing.T) {
+	if err := validateReloadStrategies(reloadSignal, map[string]string{"nginx1": reloadExec}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateReloadStrategies("", map[string]string{"nginx1": "hup"}); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+}
+
+func TestValidateNginxConfigs(t *testing.T) {
+	fake := &fakeDocker{
+		errors: map[string]error{"exec_nginx1": fmt.Errorf("container nginx1 is not running")},
+		execResults: map[string]fakeExecResult{
+			"nginx2:nginx -t": {output: "nginx: [emerg] unexpected end of file in /etc/nginx/conf.d/blocklist.conf:12", exitCode: 1},
+		},
+	}
+
+	err := validateNginxConfigs(fake, []string{"nginx1", "nginx2", "nginx3"})
+	if err == nil {
+		t.Fatal("expected an error when nginx rejects the config")
+	}
+	if !strings.Contains(err.Error(), "nginx2") || !strings.Contains(err.Error(), "unexpected end of file") {
+		t.Errorf("error should name the container and carry nginx's output: %v", err)
+	}
+	if got := fmt.Sprint(fake.execs); got != "[nginx1:nginx -t nginx2:nginx -t]" {
+		t.Errorf("execs = %s, want the stopped container skipped and nginx3 never tested", got)
+	}
+
+	if err := validateNginxConfigs(&fakeDocker{}, []string{"nginx1"}); err != nil {
+		t.Errorf("unexpected error for a passing config test: %v", err)
+	}
+}
+
+func TestResolveNginxContainersByLabel(t *testing.T) {
+	replica := func(name, service string, state container.ContainerState) container.Summary {
+		return container.Summary{
+			Names:  []string{"/" + name},
+			State:  state,
+			Labels: map[string]string{"com.docker.compose.service": service, "etr.reload": "true"},
+		}
+	}
+	fake := &fakeDocker{containers: []container.Summary{
+		replica("stack-nginx-2", "nginx", container.StateRunning),
+		replica("stack-nginx-1", "nginx", container.StateRunning),
+		replica("stack-nginx-3", "nginx", container.StateExited),
+		replica("stack-app-1", "app", container.StateRunning),
+	}}
+	labels := []string{"etr.reload=true", "com.docker.compose.service=nginx"}
+
+	got, err := resolveNginxContainers(fake, []string{"legacy-nginx", "stack-nginx-1"}, labels, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "[legacy-nginx stack-nginx-1 stack-nginx-2]"; fmt.Sprint(got) != want {
+		t.Errorf("targets = %v, want %s", got, want)
+	}
+
+	if _, err := resolveNginxContainers(fake, nil, labels, 3); err == nil || !strings.Contains(err.Error(), "found 2") {
+		t.Errorf("expected a count mismatch error, got %v", err)
+	}
+}
+
+func TestValidateContainerLabels(t *testing.T) {
+	for _, tt := range []struct {
+		labels   []string
+		expected int
+		wantErr  bool
+	}{
+		{labels: []string{"etr.reload=true", "etr.reload"}},
+		{labels: []string{"=true"}, wantErr: true},
+		{labels: []string{"etr.reload"}, expected: -1, wantErr: true},
+		{expected: 2, wantErr: true},
+	} {
+		if err := validateContainerLabels(tt.labels, tt.expected); (err != nil) != tt.wantErr {
+			t.Errorf("validateContainerLabels(%q, %d) error = %v, wantErr %v", tt.labels, tt.expected, err, tt.wantErr)
+		}
+	}
+}
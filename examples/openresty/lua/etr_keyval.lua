@@ -0,0 +1,108 @@
+-- The NGINX Plus keyval API contract on an OpenResty shared dict, so the rule
+-- generator's "nginx_keyval" target can update the blocklist without a reload.
+--
+--   GET    → 200 and a JSON object of every address → source label
+--   POST   → adds the keys of a JSON object; 409 if any key already exists
+--   PATCH  → sets the keys of a JSON object; a null value deletes the key
+--   DELETE → empties the zone
+--
+-- Each worker keeps a CIDR matcher (lua-resty-ipmatcher) built from the shared
+-- dict and rebuilds it when the version counter in etr_blocklist_meta changes,
+-- so a lookup is a tree walk rather than a scan of the dict.
+
+local cjson = require "cjson.safe"
+local ipmatcher = require "resty.ipmatcher"
+
+local entries = ngx.shared.etr_blocklist
+local meta = ngx.shared.etr_blocklist_meta
+
+local _M = {}
+
+local matcher, matcher_version
+
+local function all_entries()
+    local result = {}
+    for _, key in ipairs(entries:get_keys(0)) do
+        local value = entries:get(key)
+        if value then
+            result[key] = value
+        end
+    end
+    return result
+end
+
+local function bump_version()
+    meta:incr("version", 1, 0)
+end
+
+-- Same error object as NGINX Plus, which the generator quotes in its notifications.
+local function fail(status, code, text)
+    ngx.status = status
+    ngx.header.content_type = "application/json"
+    ngx.say(cjson.encode({ error = { status = status, code = code, text = text } }))
+    return ngx.exit(status)
+end
+
+-- lookup returns the source label of the network containing ip, or "" when the
+-- address is not blocked, the same values as the geo $blocked_source variable.
+function _M.lookup(ip)
+    local version = meta:get("version") or 0
+    if version ~= matcher_version then
+        local m, err = ipmatcher.new_with_value(all_entries())
+        if not m then
+            ngx.log(ngx.ERR, "etr: cannot build the blocklist matcher: ", err)
+            return ""
+        end
+        matcher, matcher_version = m, version
+    end
+    return matcher:match(ip) or ""
+end
+
+-- api serves the keyval endpoint. Only expose it to the rule generator.
+function _M.api()
+    local method = ngx.req.get_method()
+
+    if method == "GET" then
+        ngx.header.content_type = "application/json"
+        ngx.say(cjson.encode(all_entries()))
+        return
+    end
+    if method == "DELETE" then
+        entries:flush_all()
+        bump_version()
+        return ngx.exit(ngx.HTTP_NO_CONTENT)
+    end
+    if method ~= "POST" and method ~= "PATCH" then
+        return fail(405, "MethodNotAllowed", "method not supported")
+    end
+
+    ngx.req.read_body()
+    local data = cjson.decode(ngx.req.get_body_data() or "")
+    if type(data) ~= "table" then
+        return fail(400, "KeyvalFormatError", "the body must be a JSON object")
+    end
+    for key, value in pairs(data) do
+        if type(key) ~= "string" or (type(value) ~= "string" and value ~= cjson.null) then
+            return fail(400, "KeyvalFormatError", "values must be strings or null")
+        end
+        if method == "POST" and entries:get(key) ~= nil then
+            return fail(409, "KeyvalKeyExists", "key \"" .. key .. "\" already exists")
+        end
+    end
+
+    for key, value in pairs(data) do
+        if value == cjson.null then
+            entries:delete(key)
+        else
+            local ok, err = entries:safe_set(key, value)
+            if not ok then
+                bump_version()
+                return fail(507, "KeyvalNoMemory", "cannot store \"" .. key .. "\": " .. err)
+            end
+        end
+    end
+    bump_version()
+    return ngx.exit(method == "POST" and ngx.HTTP_CREATED or ngx.HTTP_NO_CONTENT)
+end
+
+return _M
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// exportRecord is one final network of the carved blocklist with its full provenance:
+// which entry it came from, every source that listed it, and which whitelist entries carved it.
+type exportRecord struct {
+	Network     string         `json:"network"`
+	Original    string         `json:"original"`
+	Label       string         `json:"label"`
+	Sources     []exportSource `json:"sources"`
+	CarvedBy    []exportCarve  `json:"carved_by"`
+	CarveResult string         `json:"carve_result"`
+	Score       int            `json:"score"`
+	FirstSeen   string         `json:"first_seen,omitempty"`
+}
+
+// exportSource is one blocklist that listed the network.
+type exportSource struct {
+	URL   string `json:"url"`
+	Label string `json:"label"`
+}
+
+// exportCarve is one whitelist entry that was subtracted from the original entry.
+type exportCarve struct {
+	Entry  string `json:"entry"`
+	Source string `json:"source"`
+}
+
+// exportRecords builds one record per final network, in address order.
+func exportRecords(gen *generation) []exportRecord {
+	records := make([]exportRecord, 0, len(gen.entries))
+	for _, e := range gen.entries {
+		r := exportRecord{
+			Network:     e.addr,
+			Original:    e.original,
+			Label:       e.label,
+			Sources:     make([]exportSource, 0, len(e.sources)),
+			CarvedBy:    make([]exportCarve, 0, len(e.carvedBy)),
+			CarveResult: e.carveResult(),
+			Score:       gen.score(e),
+			FirstSeen:   gen.firstSeen[e.addr],
+		}
+		if r.Original == "" {
+			r.Original = e.addr
+		}
+		for _, src := range e.sources {
+			r.Sources = append(r.Sources, exportSource{URL: sourceKey(src), Label: labelFromSource(src)})
+		}
+		for _, wl := range e.carvedBy {
+			r.CarvedBy = append(r.CarvedBy, exportCarve{Entry: wl, Source: gen.whitelist[wl]})
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// renderJSON renders the carved blocklist as a JSON array of exportRecord, for audits and SIEM
+// ingestion. Unlike $blocked_source, nothing is collapsed into a "+"-joined label.
+func renderJSON(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	data, err := json.MarshalIndent(exportRecords(gen), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return []renderedFile{{path: out.Path, content: append(data, '\n')}}, nil
+}
+
+// renderCSV renders the same records as CSV with a header row. Multi-valued columns
+// (source_urls, source_labels, carved_by, carved_by_sources) are space-separated.
+func renderCSV(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if err := w.Write([]string{
+		"network", "original", "label", "source_urls", "source_labels",
+		"carved_by", "carved_by_sources", "carve_result", "score", "first_seen",
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, r := range exportRecords(gen) {
+		var urls, labels, carved, carvedSources []string
+		for _, s := range r.Sources {
+			urls = append(urls, s.URL)
+			labels = append(labels, s.Label)
+		}
+		for _, c := range r.CarvedBy {
+			carved = append(carved, c.Entry)
+			carvedSources = append(carvedSources, c.Source)
+		}
+		if err := w.Write([]string{
+			r.Network, r.Original, r.Label,
+			strings.Join(urls, " "), strings.Join(labels, " "),
+			strings.Join(carved, " "), strings.Join(carvedSources, " "),
+			r.CarveResult, strconv.Itoa(r.Score), r.FirstSeen,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return []renderedFile{{path: out.Path, content: b.Bytes()}}, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCarveBlocklistProvenance(t *testing.T) {
+	whitelist := map[string]string{
+		"198.51.100.5":   "local_whitelist",
+		"198.51.100.128": "https://example.com/allow.txt",
+		"10.0.0.0/8":     "local_whitelist",
+	}
+	blocklist := map[string][]string{
+		"198.51.100.0/24": {testIpsumURL, testCompromisedURL},
+		"203.0.113.9":     {testIpsumURL},
+	}
+
+	entries := carveBlocklist(whitelist, blocklist)
+
+	var split, unchanged int
+	for _, e := range entries {
+		switch e.original {
+		case "198.51.100.0/24":
+			split++
+			if e.carveResult() != carveSplit {
+				t.Errorf("%s: carve result %q, want %q", e.addr, e.carveResult(), carveSplit)
+			}
+			if !reflect.DeepEqual(e.carvedBy, []string{"198.51.100.128", "198.51.100.5"}) {
+				t.Errorf("%s: carvedBy = %v", e.addr, e.carvedBy)
+			}
+		case "203.0.113.9":
+			unchanged++
+			if e.carveResult() != carveUnchanged || len(e.carvedBy) != 0 {
+				t.Errorf("%s: expected unchanged entry, got %+v", e.addr, e)
+			}
+		default:
+			t.Errorf("unexpected original %q for %s", e.original, e.addr)
+		}
+	}
+	if split == 0 || unchanged != 1 {
+		t.Errorf("expected split sub-ranges and one unchanged entry, got %d/%d", split, unchanged)
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	gen := &generation{
+		entries: []blocklistEntry{
+			{
+				addr: "198.51.100.0/30", label: "ipsum-8+compromised-ips",
+				sources:  []string{testIpsumURL, testCompromisedURL},
+				original: "198.51.100.0/24", carvedBy: []string{"198.51.100.5"},
+			},
+		},
+		whitelist: map[string]string{"198.51.100.5": "local_whitelist"},
+		firstSeen: map[string]string{"198.51.100.0/30": "2026-02-01"},
+	}
+
+	files, err := renderJSON(OutputConfig{Path: "etr.json"}, gen)
+	if err != nil {
+		t.Fatalf("renderJSON: %v", err)
+	}
+
+	var got []exportRecord
+	if err := json.Unmarshal(files[0].content, &got); err != nil {
+		t.Fatalf("output is not valid JSON: %v", err)
+	}
+	want := []exportRecord{{
+		Network:  "198.51.100.0/30",
+		Original: "198.51.100.0/24",
+		Label:    "ipsum-8+compromised-ips",
+		Sources: []exportSource{
+			{URL: testIpsumURL, Label: "ipsum-8"},
+			{URL: testCompromisedURL, Label: "compromised-ips"},
+		},
+		CarvedBy:    []exportCarve{{Entry: "198.51.100.5", Source: "local_whitelist"}},
+		CarveResult: carveSplit,
+		Score:       2,
+		FirstSeen:   "2026-02-01",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestRenderCSV(t *testing.T) {
+	gen := &generation{
+		entries: []blocklistEntry{
+			{addr: "203.0.113.9", label: "ipsum-8", sources: []string{testIpsumURL}, original: "203.0.113.9"},
+		},
+	}
+
+	files, err := renderCSV(OutputConfig{Path: "etr.csv"}, gen)
+	if err != nil {
+		t.Fatalf("renderCSV: %v", err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(string(files[0].content))).ReadAll()
+	if err != nil {
+		t.Fatalf("output is not valid CSV: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected header and one row, got %d rows", len(rows))
+	}
+	want := []string{"203.0.113.9", "203.0.113.9", "ipsum-8", testIpsumURL, "ipsum-8", "", "", "unchanged", "1", ""}
+	if !reflect.DeepEqual(rows[1], want) {
+		t.Errorf("row = %q\nwant  %q", rows[1], want)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+)
+
+// ipsetMaxElem is the maxelem of both the live and the temporary set. "create -exist" only
+// accepts an existing set with identical parameters, and swap carries the temporary set's
+// parameters over to the live name, so the value must not depend on the list size. It is a
+// limit, not an allocation, and leaves room for the largest feeds (ipsum level 1).
+const ipsetMaxElem = 1 << 20
+
+// renderNftables renders an `nft -f` script that declares an inet table with interval sets
+// for IPv4 and IPv6 and repopulates them. nft applies a script as one transaction, so the sets
+// are flushed and refilled atomically; packets never see an empty set.
+// The script only manages the sets — reference them from your own chains, e.g.
+//
+//	ip saddr @blocklist_v4 drop
+//	ip6 saddr @blocklist_v6 drop
+func renderNftables(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	table := outputName(out)
+	v4, v6 := collapseNetworks(gen.entries)
+
+	var b bytes.Buffer
+	b.WriteString("#!/usr/sbin/nft -f\n")
+	b.WriteString("# Generated by emerging-threats-rules; overwritten on every run.\n\n")
+	fmt.Fprintf(&b, "table inet %s {\n", table)
+	b.WriteString("    set blocklist_v4 {\n        type ipv4_addr\n        flags interval\n    }\n")
+	b.WriteString("    set blocklist_v6 {\n        type ipv6_addr\n        flags interval\n    }\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "flush set inet %s blocklist_v4\n", table)
+	fmt.Fprintf(&b, "flush set inet %s blocklist_v6\n", table)
+	writeNftElements(&b, table, "blocklist_v4", v4)
+	writeNftElements(&b, table, "blocklist_v6", v6)
+
+	return []renderedFile{{path: out.Path, content: b.Bytes()}}, nil
+}
+
+// writeNftElements appends an "add element" statement; nft rejects an empty element list,
+// so nothing is written when nets is empty.
+func writeNftElements(b *bytes.Buffer, table, set string, nets []*net.IPNet) {
+	if len(nets) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "\nadd element inet %s %s {\n    %s\n}\n", table, set, joinNetworks(nets, ",\n    "))
+}
+
+// renderIpset renders an `ipset restore` file using hash:net sets with swap semantics:
+// entries are loaded into a temporary set which is then swapped with the live one and destroyed,
+// so iptables rules referencing <name>-v4 / <name>-v6 switch lists in a single step.
+func renderIpset(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	name := outputName(out)
+	v4, v6 := collapseNetworks(gen.entries)
+	if n := max(len(v4), len(v6)); n > ipsetMaxElem {
+		return nil, fmt.Errorf("%d networks exceed the ipset maxelem of %d", n, ipsetMaxElem)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# Generated by emerging-threats-rules; overwritten on every run.\n")
+	b.WriteString("# Apply with: ipset restore -file <this file>\n")
+	writeIpsetSwap(&b, name+"-v4", "inet", v4)
+	writeIpsetSwap(&b, name+"-v6", "inet6", v6)
+
+	return []renderedFile{{path: out.Path, content: b.Bytes()}}, nil
+}
+
+func writeIpsetSwap(b *bytes.Buffer, set, family string, nets []*net.IPNet) {
+	tmp := set + "-tmp"
+	fmt.Fprintf(b, "\ncreate %s hash:net family %s hashsize 1024 maxelem %d -exist\n", set, family, ipsetMaxElem)
+	fmt.Fprintf(b, "create %s hash:net family %s hashsize 1024 maxelem %d -exist\n", tmp, family, ipsetMaxElem)
+	fmt.Fprintf(b, "flush %s\n", tmp)
+	for _, n := range nets {
+		// hash:net cannot store a /0; such an entry would block the whole family anyway.
+		if ones, _ := n.Mask.Size(); ones == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "add %s %s\n", tmp, n.String())
+	}
+	fmt.Fprintf(b, "swap %s %s\n", tmp, set)
+	fmt.Fprintf(b, "destroy %s\n", tmp)
+}
+
+// renderPf renders a pf table file for pfSense, OPNsense and other BSD firewalls, one CIDR per
+// line, loadable with `table <etr> persist file "<path>"` or `pfctl -t etr -T replace -f <path>`.
+// Two sidecars are written next to it:
+//   - <path>.urltable — the same networks with no comments, for pfSense's
+//     Firewall → Aliases → URL Table (IPs), fetched over HTTP from the nginx container.
+//   - <path>.labels — "<network> <label>" per carved entry, since pf tables cannot carry labels.
+func renderPf(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	v4, v6 := collapseNetworks(gen.entries)
+
+	var table, urlTable, labels bytes.Buffer
+	table.WriteString("# Generated by emerging-threats-rules; overwritten on every run.\n")
+	fmt.Fprintf(&table, "# Source labels for each network: %s.labels\n", filepath.Base(out.Path))
+	for _, n := range append(v4, v6...) {
+		fmt.Fprintf(&table, "%s\n", n.String())
+		fmt.Fprintf(&urlTable, "%s\n", n.String())
+	}
+	for _, e := range gen.entries {
+		fmt.Fprintf(&labels, "%s %s\n", e.addr, e.label)
+	}
+
+	return []renderedFile{
+		{path: out.Path, content: table.Bytes()},
+		{path: out.Path + ".urltable", content: urlTable.Bytes()},
+		{path: out.Path + ".labels", content: labels.Bytes()},
+	}, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCollapseNetworks(t *testing.T) {
+	entries := []blocklistEntry{
+		{addr: "10.1.2.3", label: "a"},
+		{addr: "10.0.0.0/8", label: "b"},
+		{addr: "10.0.0.0/16", label: "c"},
+		{addr: "192.0.2.1", label: "a"},
+		{addr: "2001:db8::/32", label: "a"},
+		{addr: "2001:db8::1", label: "b"},
+		{addr: "2001:db9::1", label: "b"},
+		{addr: "not-an-ip", label: "x"},
+	}
+
+	v4, v6 := collapseNetworks(entries)
+
+	var got4, got6 []string
+	for _, n := range v4 {
+		got4 = append(got4, n.String())
+	}
+	for _, n := range v6 {
+		got6 = append(got6, n.String())
+	}
+	if strings.Join(got4, ",") != "10.0.0.0/8,192.0.2.1/32" {
+		t.Errorf("unexpected IPv4 networks: %v", got4)
+	}
+	if strings.Join(got6, ",") != "2001:db8::/32,2001:db9::1/128" {
+		t.Errorf("unexpected IPv6 networks: %v", got6)
+	}
+}
+
+func TestRenderNftables(t *testing.T) {
+	entries := []blocklistEntry{
+		{addr: "198.51.100.0/24", label: "a"},
+		{addr: "198.51.100.7", label: "b"},
+		{addr: "203.0.113.5", label: "a"},
+		{addr: "2001:db8::/32", label: "a"},
+	}
+	out := OutputConfig{Format: "nftables", Path: filepath.Join(t.TempDir(), "etr.nft"), Name: "edge"}
+
+	files, err := renderNftables(out, &generation{entries: entries})
+	if err != nil {
+		t.Fatalf("renderNftables: %v", err)
+	}
+	if len(files) != 1 || files[0].path != out.Path {
+		t.Fatalf("expected one file at %s, got %+v", out.Path, files)
+	}
+	content := string(files[0].content)
+
+	for _, want := range []string{
+		"table inet edge {",
+		"set blocklist_v4 {\n        type ipv4_addr\n        flags interval\n    }",
+		"set blocklist_v6 {\n        type ipv6_addr\n        flags interval\n    }",
+		"flush set inet edge blocklist_v4\n",
+		"flush set inet edge blocklist_v6\n",
+		"add element inet edge blocklist_v4 {\n    198.51.100.0/24,\n    203.0.113.5/32\n}",
+		"add element inet edge blocklist_v6 {\n    2001:db8::/32\n}",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected %q in nft script:\n%s", want, content)
+		}
+	}
+	if strings.Contains(content, "198.51.100.7") {
+		t.Errorf("address covered by a wider network must be collapsed:\n%s", content)
+	}
+}
+
+func TestRenderNftablesEmpty(t *testing.T) {
+	files, err := renderNftables(OutputConfig{Path: "etr.nft"}, &generation{})
+	if err != nil {
+		t.Fatalf("renderNftables: %v", err)
+	}
+	content := string(files[0].content)
+	if strings.Contains(content, "add element") {
+		t.Errorf("empty blocklist must not emit an empty element list:\n%s", content)
+	}
+	if !strings.Contains(content, "flush set inet etr blocklist_v4") {
+		t.Errorf("empty blocklist must still flush the sets:\n%s", content)
+	}
+}
+
+func TestRenderIpset(t *testing.T) {
+	entries := []blocklistEntry{
+		{addr: "198.51.100.0/24", label: "a"},
+		{addr: "203.0.113.5", label: "a"},
+		{addr: "2001:db8::1", label: "a"},
+	}
+
+	files, err := renderIpset(OutputConfig{Path: "etr.ipset"}, &generation{entries: entries})
+	if err != nil {
+		t.Fatalf("renderIpset: %v", err)
+	}
+	content := string(files[0].content)
+
+	for _, want := range []string{
+		"create etr-v4 hash:net family inet hashsize 1024 maxelem 1048576 -exist\n",
+		"create etr-v4-tmp hash:net family inet hashsize 1024 maxelem 1048576 -exist\n",
+		"flush etr-v4-tmp\nadd etr-v4-tmp 198.51.100.0/24\nadd etr-v4-tmp 203.0.113.5/32\nswap etr-v4-tmp etr-v4\ndestroy etr-v4-tmp\n",
+		"create etr-v6 hash:net family inet6 hashsize 1024 maxelem 1048576 -exist\n",
+		"add etr-v6-tmp 2001:db8::1/128\nswap etr-v6-tmp etr-v6\ndestroy etr-v6-tmp\n",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected %q in ipset file:\n%s", want, content)
+		}
+	}
+}
+
+func TestRenderIpsetLargeList(t *testing.T) {
+	// More networks than ipset's default maxelem, none adjacent enough to collapse.
+	entries := make([]blocklistEntry, 0, 70000)
+	for i := 0; i < cap(entries); i++ {
+		entries = append(entries, blocklistEntry{addr: fmt.Sprintf("10.%d.%d.1", i/256, i%256), label: "ipsum-1"})
+	}
+
+	files, err := renderIpset(OutputConfig{Path: "etr.ipset"}, &generation{entries: entries})
+	if err != nil {
+		t.Fatalf("renderIpset: %v", err)
+	}
+	var creates []string
+	for _, line := range strings.Split(string(files[0].content), "\n") {
+		if strings.HasPrefix(line, "create etr-v4") {
+			creates = append(creates, strings.Replace(line, "etr-v4-tmp ", "etr-v4 ", 1))
+		}
+	}
+	if len(creates) != 2 || creates[0] != creates[1] {
+		t.Errorf("the live and temporary sets must be created alike, got %q", creates)
+	}
+}
+
+func TestRenderPf(t *testing.T) {
+	entries := []blocklistEntry{
+		{addr: "198.51.100.0/24", label: "ipsum-8"},
+		{addr: "198.51.100.7", label: "compromised-ips"},
+		{addr: "2001:db8::/32", label: "ipsum-8+local"},
+	}
+	path := filepath.Join(t.TempDir(), "etr.pf")
+
+	files, err := renderPf(OutputConfig{Format: "pf", Path: path}, &generation{entries: entries})
+	if err != nil {
+		t.Fatalf("renderPf: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected table, URL table and labels files, got %d", len(files))
+	}
+
+	got := make(map[string]string)
+	for _, f := range files {
+		got[f.path] = string(f.content)
+	}
+
+	table := got[path]
+	if !strings.HasPrefix(table, "# ") {
+		t.Errorf("pf table should start with a comment header:\n%s", table)
+	}
+	if !strings.HasSuffix(table, "198.51.100.0/24\n2001:db8::/32\n") {
+		t.Errorf("unexpected pf table body:\n%s", table)
+	}
+
+	if urlTable := got[path+".urltable"]; urlTable != "198.51.100.0/24\n2001:db8::/32\n" {
+		t.Errorf("URL table must hold bare networks only, got:\n%s", urlTable)
+	}
+
+	wantLabels := "198.51.100.0/24 ipsum-8\n198.51.100.7 compromised-ips\n2001:db8::/32 ipsum-8+local\n"
+	if labels := got[path+".labels"]; labels != wantLabels {
+		t.Errorf("unexpected labels sidecar:\n%s", labels)
+	}
+}
@@ -2,14 +2,18 @@ module nginx_blacklist
 
 go 1.26.0
 
-require github.com/moby/moby/api v1.55.0 // indirect
+require github.com/moby/moby/api v1.55.0
 
-require github.com/moby/moby/client v0.5.0
+require (
+	github.com/containerd/errdefs v1.0.0
+	github.com/maxmind/mmdbwriter v1.2.0
+	github.com/moby/moby/client v0.5.0
+	github.com/oschwald/maxminddb-golang/v2 v2.1.1
+)
 
 require (
 	github.com/Microsoft/go-winio v0.6.2 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/containerd/errdefs v1.0.0 // indirect
 	github.com/containerd/errdefs/pkg v0.3.0 // indirect
 	github.com/distribution/reference v0.6.0 // indirect
 	github.com/docker/go-connections v0.7.0 // indirect
@@ -25,5 +29,6 @@ require (
 	go.opentelemetry.io/otel v1.44.0 // indirect
 	go.opentelemetry.io/otel/metric v1.44.0 // indirect
 	go.opentelemetry.io/otel/trace v1.44.0 // indirect
+	go4.org/netipx v0.0.0-20231129151722-fdeea329fbba // indirect
 	golang.org/x/sys v0.46.0 // indirect
 )
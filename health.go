@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+)
+
+// Health probes selected by nginx_health_probe.
+const (
+	healthProbeDocker = "docker" // Docker's healthcheck status; just "running" without a healthcheck
+	healthProbeTCP    = "tcp"    // a TCP connect to the container's address
+	healthProbeHTTP   = "http"   // GET /check_ip on the container's address must return 200
+)
+
+const (
+	defaultHealthPort    = 80
+	defaultHealthTimeout = 60 * time.Second
+	healthProbeTimeout   = 2 * time.Second
+)
+
+// healthPollInterval is how often a replica is re-checked. Declared as a var so tests can
+// shorten it.
+var healthPollInterval = 2 * time.Second
+
+// probeClient is used for health probes only. Probes target private container addresses on
+// purpose, so they must not go through the SSRF-guarded httpClient.
+var probeClient = &http.Client{Timeout: healthProbeTimeout}
+
+// healthGate decides when a reloaded replica is back in service, so a rollout can move on to
+// the next one. The zero value waits up to a minute for Docker's health status.
+type healthGate struct {
+	probe   string
+	port    int
+	timeout time.Duration
+}
+
+// newHealthGate builds the gate from nginx_health_probe, nginx_health_port and
+// nginx_health_timeout (seconds), applying defaults for unset values.
+func newHealthGate(probe string, port, timeoutSeconds int) (healthGate, error) {
+	switch probe {
+	case "", healthProbeDocker, healthProbeTCP, healthProbeHTTP:
+	default:
+		return healthGate{}, fmt.Errorf("unknown nginx_health_probe %q (want docker, tcp or http)", probe)
+	}
+	if port < 0 || port > 65535 {
+		return healthGate{}, fmt.Errorf("nginx_health_port %d is out of range", port)
+	}
+	if timeoutSeconds < 0 {
+		return healthGate{}, fmt.Errorf("nginx_health_timeout must not be negative, got %d", timeoutSeconds)
+	}
+	return healthGate{probe: probe, port: port, timeout: time.Duration(timeoutSeconds) * time.Second}, nil
+}
+
+// wait polls the container until it passes the gate's probe or the timeout expires, and returns
+// the last failure in that case. reloadedAt is when the reload was sent: Docker keeps reporting
+// the result of the last health check until the next one runs, so only checks started after it
+// count. An unhealthy status is not final either, for the same reason.
+func (g healthGate) wait(cli containerAPI, containerName string, reloadedAt time.Time) error {
+	timeout := g.timeout
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := g.check(cli, containerName, reloadedAt)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(healthPollInterval).After(deadline) {
+			return fmt.Errorf("not healthy after %s: %v", timeout, err)
+		}
+		time.Sleep(healthPollInterval)
+	}
+}
+
+// check runs one probe against the container. The docker probe only accepts a healthy status
+// backed by a passing health check that started after since.
+func (g healthGate) check(cli containerAPI, containerName string, since time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerOpTimeout)
+	inspected, err := cli.ContainerInspect(ctx, containerName, client.ContainerInspectOptions{})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to inspect container: %v", err)
+	}
+	state := inspected.Container.State
+	if state == nil || !state.Running {
+		status := "unknown"
+		if state != nil {
+			status = string(state.Status)
+		}
+		return fmt.Errorf("container is %s", status)
+	}
+
+	switch g.probe {
+	case healthProbeTCP, healthProbeHTTP:
+		addr, err := containerAddress(inspected.Container, g.port)
+		if err != nil {
+			return err
+		}
+		if g.probe == healthProbeTCP {
+			conn, err := net.DialTimeout("tcp", addr, healthProbeTimeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+		resp, err := probeClient.Get("http://" + addr + "/check_ip")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("/check_ip returned %s", resp.Status)
+		}
+		return nil
+	default:
+		health := state.Health
+		if health == nil || health.Status == container.NoHealthcheck {
+			return nil
+		}
+		if health.Status != container.Healthy {
+			return fmt.Errorf("health status is %s", health.Status)
+		}
+		// A signal or exec reload leaves the status of the check before it in place.
+		if !passedHealthCheckSince(health.Log, since) {
+			return fmt.Errorf("no health check has passed since the reload")
+		}
+		return nil
+	}
+}
+
+// passedHealthCheckSince reports whether the newest health check result (Docker logs them
+// oldest first) started after since and passed. Docker's clock is compared with ours, so the
+// generator and the daemon must agree on the time; otherwise use the http probe.
+func passedHealthCheckSince(log []*container.HealthcheckResult, since time.Time) bool {
+	if len(log) == 0 {
+		return false
+	}
+	last := log[len(log)-1]
+	return last != nil && last.ExitCode == 0 && last.Start.After(since)
+}
+
+// containerAddress returns host:port for the container's first network, by network name.
+func containerAddress(c container.InspectResponse, port int) (string, error) {
+	if port == 0 {
+		port = defaultHealthPort
+	}
+	if c.NetworkSettings != nil {
+		names := make([]string, 0, len(c.NetworkSettings.Networks))
+		for name := range c.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if ep := c.NetworkSettings.Networks[name]; ep != nil && ep.IPAddress.IsValid() {
+				return net.JoinHostPort(ep.IPAddress.String(), strconv.Itoa(port)), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("container has no network address to probe")
+}
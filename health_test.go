@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+)
+
+func shortenHealthPolling(t *testing.T) {
+	interval := healthPollInterval
+	healthPollInterval = time.Millisecond
+	t.Cleanup(func() { healthPollInterval = interval })
+}
+
+func TestReloadNginxContainersWaitsForHealth(t *testing.T) {
+	shortenHealthPolling(t)
+	fresh := time.Now().Add(time.Hour)
+	running := func(health container.HealthStatus, checked time.Time) container.State {
+		log := []*container.HealthcheckResult{{Start: checked, End: checked}}
+		return container.State{Status: container.StateRunning, Running: true, Health: &container.Health{Status: health, Log: log}}
+	}
+	fake := &fakeDocker{states: map[string][]container.State{
+		"nginx1": {
+			running(container.Healthy, time.Time{}), // before the restart
+			{Status: container.StateRestarting},
+			running(container.Starting, time.Time{}),
+			running(container.Healthy, fresh),
+		},
+	}}
+
+	if results := (nginxRollout{}).apply(fake, []string{"nginx1", "nginx2"}); results.failures() != 0 {
+		t.Fatalf("unexpected failures:\n%s", results.summary())
+	}
+	if fake.inspects["nginx1"] != 4 {
+		t.Errorf("nginx1 inspected %d times, want 4 (once before the restart, then until healthy)", fake.inspects["nginx1"])
+	}
+	if got := fmt.Sprint(fake.restarts); got != "[nginx1 nginx2]" {
+		t.Errorf("restarts = %s", got)
+	}
+}
+
+func TestHealthGateIgnoresStaleHealthyStatus(t *testing.T) {
+	shortenHealthPolling(t)
+	reloadedAt := time.Now()
+	healthy := func(checks ...*container.HealthcheckResult) container.State {
+		return container.State{Status: container.StateRunning, Running: true, Health: &container.Health{Status: container.Healthy, Log: checks}}
+	}
+	before := &container.HealthcheckResult{Start: reloadedAt.Add(-time.Second), ExitCode: 0}
+	failedAfter := &container.HealthcheckResult{Start: reloadedAt.Add(time.Second), ExitCode: 1}
+	passedAfter := &container.HealthcheckResult{Start: reloadedAt.Add(2 * time.Second), ExitCode: 0}
+
+	// A signal reload leaves Docker reporting the check from before it.
+	stale := &fakeDocker{states: map[string][]container.State{"nginx1": {healthy(before)}}}
+	err := healthGate{timeout: 20 * time.Millisecond}.wait(stale, "nginx1", reloadedAt)
+	if err == nil || !strings.Contains(err.Error(), "since the reload") {
+		t.Fatalf("a healthy status from before the reload should not pass, got %v", err)
+	}
+
+	fake := &fakeDocker{states: map[string][]container.State{"nginx1": {
+		healthy(before),
+		healthy(before, failedAfter),
+		healthy(before, failedAfter, passedAfter),
+	}}}
+	if err := (healthGate{}).wait(fake, "nginx1", reloadedAt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake.inspects["nginx1"] != 3 {
+		t.Errorf("nginx1 inspected %d times, want 3 (until a check after the reload passed)", fake.inspects["nginx1"])
+	}
+}
+
+func TestReloadNginxContainersAbortsOnUnhealthyReplica(t *testing.T) {
+	shortenHealthPolling(t)
+	fake := &fakeDocker{states: map[string][]container.State{
+		"nginx1": {{Status: container.StateRunning, Running: true, Health: &container.Health{Status: container.Unhealthy}}},
+	}}
+
+	results := nginxRollout{gate: healthGate{timeout: 20 * time.Millisecond}}.apply(fake, []string{"nginx1", "nginx2"})
+	if len(results) != 2 || results[0].status != resultUnhealthy || results[1].status != resultNotAttempted {
+		t.Fatalf("expected the rollout to stop at nginx1:\n%s", results.summary())
+	}
+	if !strings.Contains(results[0].err.Error(), "unhealthy") {
+		t.Errorf("result should carry the health status: %v", results[0].err)
+	}
+	if got := fmt.Sprint(fake.restarts); got != "[nginx1]" {
+		t.Errorf("restarts = %s, want nginx2 left untouched", got)
+	}
+}
+
+func TestHealthGateProbes(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/check_ip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	fake := &fakeDocker{addresses: map[string]string{"nginx1": "127.0.0.1"}}
+	for _, probe := range []string{healthProbeTCP, healthProbeHTTP} {
+		if err := (healthGate{probe: probe, port: port}).check(fake, "nginx1", time.Time{}); err != nil {
+			t.Errorf("%s probe: unexpected error: %v", probe, err)
+		}
+	}
+
+	status = http.StatusForbidden
+	if err := (healthGate{probe: healthProbeHTTP, port: port}).check(fake, "nginx1", time.Time{}); err == nil {
+		t.Error("http probe should fail when /check_ip does not return 200")
+	}
+	if err := (healthGate{probe: healthProbeTCP, port: port}).check(fake, "nginx2", time.Time{}); err == nil {
+		t.Error("tcp probe should fail for a container without an address")
+	}
+}
+
+func TestNewHealthGate(t *testing.T) {
+	gate, err := newHealthGate(healthProbeHTTP, 8080, 30)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (healthGate{probe: healthProbeHTTP, port: 8080, timeout: 30 * time.Second}); gate != want {
+		t.Errorf("gate = %+v, want %+v", gate, want)
+	}
+
+	for _, tt := range []struct {
+		probe         string
+		port, timeout int
+	}{
+		{probe: "ping"},
+		{port: 70000},
+		{timeout: -1},
+	} {
+		if _, err := newHealthGate(tt.probe, tt.port, tt.timeout); err == nil {
+			t.Errorf("newHealthGate(%q, %d, %d): expected an error", tt.probe, tt.port, tt.timeout)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// historyDirName is the directory next to blocklist.conf holding past generations, one
+// subdirectory each. nginx's "include conf.d/*.conf" does not descend into it.
+const historyDirName = "history"
+
+// defaultHistorySize is how many generations are kept when nginx_history_size is unset.
+const defaultHistorySize = 7
+
+// historyIDLayout names each generation after its UTC generation time, so names sort
+// chronologically.
+const historyIDLayout = "20060102T150405Z"
+
+// historyMetaFileName describes a generation; see historyMeta.
+const historyMetaFileName = "meta.json"
+
+// historyMeta is the metadata stored with each generation.
+type historyMeta struct {
+	Generation  string         `json:"generation"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	Version     string         `json:"version"`
+	Instance    string         `json:"instance,omitempty"`
+	Layout      string         `json:"layout"`
+	Entries     int            `json:"entries"`
+	Listed      int            `json:"listed"`
+	Sources     map[string]int `json:"sources,omitempty"`
+	// SHA256 is the digest of the generation's blocklist.conf, used to find the live generation.
+	SHA256 string `json:"sha256"`
+}
+
+// historyDir returns the history location for a given nginx conf path.
+func historyDir(confFilePath string) string {
+	return filepath.Join(filepath.Dir(confFilePath), historyDirName)
+}
+
+// recordHistory copies the nginx files written for gen, once every reload target accepted them,
+// into a new generation directory and prunes all but the newest size generations. It returns
+// the generation name, or "" when the history is disabled (negative size).
+//
+// The copy is staged in a hidden directory and renamed into place, so an interrupted run never
+// leaves a half-recorded generation for rollback to restore.
+func recordHistory(confFilePath string, gen *generation, layout string, size int) (string, error) {
+	if size < 0 {
+		return "", nil
+	}
+	if size == 0 {
+		size = defaultHistorySize
+	}
+	if layout == "" {
+		layout = geoLayoutSingle
+	}
+
+	root := historyDir(confFilePath)
+	id := gen.generatedAt.UTC().Format(historyIDLayout)
+	staging := filepath.Join(root, "."+id+".tmp")
+	if err := os.RemoveAll(staging); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+
+	master, err := os.ReadFile(confFilePath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(master)
+	files := map[string][]byte{filepath.Base(confFilePath): master}
+
+	whitelistPath := whitelistConfPath(confFilePath)
+	if content, err := os.ReadFile(whitelistPath); err == nil {
+		files[filepath.Base(whitelistPath)] = content
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	if layout == geoLayoutPerSource {
+		if err := os.MkdirAll(filepath.Join(staging, includeDirName), 0755); err != nil {
+			return "", err
+		}
+		includes, err := referencedIncludes(confFilePath)
+		if err != nil {
+			return "", err
+		}
+		for _, include := range includes {
+			content, err := os.ReadFile(include)
+			if err != nil {
+				return "", err
+			}
+			files[filepath.Join(includeDirName, filepath.Base(include))] = content
+		}
+	}
+
+	meta, err := json.MarshalIndent(historyMeta{
+		Generation:  id,
+		GeneratedAt: gen.generatedAt,
+		Version:     version,
+		Instance:    gen.instance,
+		Layout:      layout,
+		Entries:     len(gen.entries),
+		Listed:      gen.listed,
+		Sources:     gen.sourceCounts,
+		SHA256:      hex.EncodeToString(sum[:]),
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	files[historyMetaFileName] = meta
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(staging, name), content, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	target := filepath.Join(root, id)
+	if err := os.RemoveAll(target); err != nil {
+		return "", err
+	}
+	if err := os.Rename(staging, target); err != nil {
+		return "", err
+	}
+	return id, pruneHistory(root, size)
+}
+
+// pruneHistory removes all but the newest size generations.
+func pruneHistory(root string, size int) error {
+	generations, err := historyGenerations(root)
+	if err != nil {
+		return err
+	}
+	for len(generations) > size {
+		if err := os.RemoveAll(filepath.Join(root, generations[0])); err != nil {
+			return err
+		}
+		generations = generations[1:]
+	}
+	return nil
+}
+
+// historyGenerations returns the recorded generation names, oldest first.
+func historyGenerations(root string) ([]string, error) {
+	dirEntries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var generations []string
+	for _, d := range dirEntries {
+		if d.IsDir() && !strings.HasPrefix(d.Name(), ".") {
+			generations = append(generations, d.Name())
+		}
+	}
+	sort.Strings(generations)
+	return generations, nil
+}
+
+// loadHistoryMeta reads a generation's metadata.
+func loadHistoryMeta(root, id string) (historyMeta, error) {
+	var meta historyMeta
+	data, err := os.ReadFile(filepath.Join(root, id, historyMetaFileName))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("parse %s metadata: %v", id, err)
+	}
+	return meta, nil
+}
+
+// selectRollbackTarget picks the generation to restore. An explicit request must name a recorded
+// generation. Without one, the target is the generation before the live one, found by the digest
+// of the live blocklist.conf, so repeated rollbacks step further back. If the live file is not
+// in the history (e.g. it was edited by hand), the newest generation is restored.
+func selectRollbackTarget(confFilePath, requested string) (historyMeta, error) {
+	root := historyDir(confFilePath)
+	generations, err := historyGenerations(root)
+	if err != nil {
+		return historyMeta{}, err
+	}
+	if len(generations) == 0 {
+		return historyMeta{}, fmt.Errorf("no generations recorded in %s", root)
+	}
+
+	if requested != "" {
+		for _, id := range generations {
+			if id == requested {
+				return loadHistoryMeta(root, id)
+			}
+		}
+		return historyMeta{}, fmt.Errorf("generation %q not found; available: %s", requested, strings.Join(generations, ", "))
+	}
+
+	live := ""
+	if content, err := os.ReadFile(confFilePath); err == nil {
+		sum := sha256.Sum256(content)
+		live = hex.EncodeToString(sum[:])
+	}
+	target := len(generations) - 1
+	for i := len(generations) - 1; i >= 0; i-- {
+		meta, err := loadHistoryMeta(root, generations[i])
+		if err == nil && meta.SHA256 == live {
+			if i == 0 {
+				return historyMeta{}, fmt.Errorf("the live blocklist is the oldest recorded generation (%s)", generations[i])
+			}
+			target = i - 1
+			break
+		}
+	}
+	return loadHistoryMeta(root, generations[target])
+}
+
+// restoreGeneration puts a recorded generation's nginx files back in place through the same
+// writers as a normal run, so blocklist.conf keeps its .bak copy and .sha256 sidecar.
+func restoreGeneration(confFilePath string, meta historyMeta) error {
+	dir := filepath.Join(historyDir(confFilePath), meta.Generation)
+	master, err := os.ReadFile(filepath.Join(dir, filepath.Base(confFilePath)))
+	if err != nil {
+		return err
+	}
+
+	whitelistPath := whitelistConfPath(confFilePath)
+	whitelist, err := os.ReadFile(filepath.Join(dir, filepath.Base(whitelistPath)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := keepBackup(whitelistPath); err != nil {
+			return fmt.Errorf("failed to back up whitelist file: %v", err)
+		}
+		if err := writeFileAtomic(whitelistPath, whitelist); err != nil {
+			return fmt.Errorf("failed to restore whitelist file: %v", err)
+		}
+	}
+
+	if meta.Layout != geoLayoutPerSource {
+		return writeSingleGeoMaster(confFilePath, master)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, includeDirName, "*.conf"))
+	if err != nil {
+		return err
+	}
+	liveDir := filepath.Join(filepath.Dir(confFilePath), includeDirName)
+	includes := make([]renderedFile, 0, len(paths))
+	for _, p := range paths {
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		includes = append(includes, renderedFile{path: filepath.Join(liveDir, filepath.Base(p)), content: content})
+	}
+	return writePerSourceFiles(confFilePath, master, includes)
+}
+
+// runRollback implements "rollback [generation]": it restores a recorded generation, then
+// config-tests it, runs the hooks and applies it to the reload targets exactly like a normal run.
+func runRollback(config *Config, requested string, gate healthGate, notifiers []Notifier, subjectPrefix string) {
+	meta, err := selectRollbackTarget(config.ConfFilePath, requested)
+	if err != nil {
+		logf("Rollback failed: %v\n", err)
+		return
+	}
+	var previous map[string]string
+	if len(config.PostApplyHooks) > 0 {
+		previous, _ = readLiveGeoEntries(config.ConfFilePath)
+	}
+	if err := restoreGeneration(config.ConfFilePath, meta); err != nil {
+		msg := fmt.Sprintf("Rollback to generation %s failed: %v", meta.Generation, err)
+		logf("%s\n", msg)
+		notify(notifiers, subjectPrefix+"Rollback failed", msg)
+		return
+	}
+	logf("Restored generation %s (generated %s by %s, %d entries).\n",
+		meta.Generation, meta.GeneratedAt.Format(time.RFC3339), meta.Version, meta.Entries)
+
+	applyNginxFiles(config, gate, "rollback", meta.Generation, previous, notifiers, subjectPrefix)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeHistoryGeneration writes the nginx files for one run and records them, as main does.
+func writeHistoryGeneration(t *testing.T, confPath, layout string, at time.Time, entries ...blocklistEntry) string {
+	t.Helper()
+	gen := &generation{entries: entries, generatedAt: at, listed: len(entries)}
+	var err error
+	if layout == geoLayoutPerSource {
+		err = writePerSourceGeoFiles(gen, confPath, "")
+	} else {
+		err = writeGeoFile(gen, confPath)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeWhitelistFile(nil, whitelistConfPath(confPath)); err != nil {
+		t.Fatal(err)
+	}
+	id, err := recordHistory(confPath, gen, layout, 2)
+	if err != nil {
+		t.Fatalf("recordHistory: %v", err)
+	}
+	return id
+}
+
+func TestRecordHistoryKeepsNewestGenerations(t *testing.T) {
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	start := time.Date(2026, 3, 12, 2, 30, 0, 0, time.UTC)
+
+	var ids []string
+	for day := 0; day < 3; day++ {
+		at := start.AddDate(0, 0, day)
+		ids = append(ids, writeHistoryGeneration(t, confPath, "", at, blocklistEntry{addr: fmt.Sprintf("192.0.2.%d", day), label: "ipsum-8"}))
+	}
+
+	got, err := historyGenerations(historyDir(confPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"20260313T023000Z", "20260314T023000Z"}; !reflect.DeepEqual(got, want) || ids[2] != want[1] {
+		t.Fatalf("generations = %v (recorded %v), want %v", got, ids, want)
+	}
+
+	meta, err := loadHistoryMeta(historyDir(confPath), ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Layout != geoLayoutSingle || meta.Entries != 1 || meta.Version != version || !meta.GeneratedAt.Equal(start.AddDate(0, 0, 2)) {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+	if _, err := os.Stat(filepath.Join(historyDir(confPath), ids[2], "whitelist.conf")); err != nil {
+		t.Errorf("whitelist.conf should be recorded: %v", err)
+	}
+
+	if id, err := recordHistory(confPath, &generation{generatedAt: start}, "", -1); err != nil || id != "" {
+		t.Errorf("a negative size should disable the history, got %q, %v", id, err)
+	}
+}
+
+func TestRollbackTargetsNewestAcceptedGeneration(t *testing.T) {
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	at := time.Date(2026, 3, 13, 2, 30, 0, 0, time.UTC)
+	writeHistoryGeneration(t, confPath, "", at, blocklistEntry{addr: "192.0.2.1", label: "ipsum-8"})
+	accepted := writeHistoryGeneration(t, confPath, "", at.AddDate(0, 0, 1), blocklistEntry{addr: "192.0.2.2", label: "ipsum-8"})
+
+	// Written but never accepted by the reload targets, so never recorded.
+	gen := &generation{entries: []blocklistEntry{{addr: "0.0.0.0/0", label: "bad-feed"}}, generatedAt: at.AddDate(0, 0, 2)}
+	if err := writeGeoFile(gen, confPath); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := selectRollbackTarget(confPath, "")
+	if err != nil {
+		t.Fatalf("selectRollbackTarget: %v", err)
+	}
+	if meta.Generation != accepted {
+		t.Errorf("target = %s, want the newest accepted generation %s", meta.Generation, accepted)
+	}
+}
+
+func TestRollbackStepsBackThroughHistory(t *testing.T) {
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	yesterday := time.Date(2026, 3, 13, 2, 30, 0, 0, time.UTC)
+	first := writeHistoryGeneration(t, confPath, "", yesterday, blocklistEntry{addr: "192.0.2.1", label: "ipsum-8"})
+	good, _ := os.ReadFile(confPath)
+	writeHistoryGeneration(t, confPath, "", yesterday.AddDate(0, 0, 1), blocklistEntry{addr: "0.0.0.0/0", label: "bad-feed"})
+
+	meta, err := selectRollbackTarget(confPath, "")
+	if err != nil {
+		t.Fatalf("selectRollbackTarget: %v", err)
+	}
+	if meta.Generation != first {
+		t.Fatalf("target = %s, want the previous generation %s", meta.Generation, first)
+	}
+	if err := restoreGeneration(confPath, meta); err != nil {
+		t.Fatalf("restoreGeneration: %v", err)
+	}
+
+	restored, _ := os.ReadFile(confPath)
+	if string(restored) != string(good) {
+		t.Errorf("blocklist.conf not restored:\n%s", restored)
+	}
+	if _, err := verifyChecksumFile(confPath); err != nil {
+		t.Errorf("checksum sidecar should match the restored file: %v", err)
+	}
+
+	if _, err := selectRollbackTarget(confPath, ""); err == nil || !strings.Contains(err.Error(), "oldest") {
+		t.Errorf("expected no older generation to roll back to, got %v", err)
+	}
+	if _, err := selectRollbackTarget(confPath, "20200101T000000Z"); err == nil || !strings.Contains(err.Error(), first) {
+		t.Errorf("an unknown generation should list the available ones, got %v", err)
+	}
+}
+
+func TestRestoreGenerationPerSource(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "blocklist.conf")
+	at := time.Date(2026, 3, 13, 2, 30, 0, 0, time.UTC)
+	first := writeHistoryGeneration(t, confPath, geoLayoutPerSource, at, blocklistEntry{addr: "192.0.2.1", label: "ipsum-8"})
+	writeHistoryGeneration(t, confPath, geoLayoutPerSource, at.AddDate(0, 0, 1), blocklistEntry{addr: "0.0.0.0/0", label: "bad-feed"})
+
+	meta, err := loadHistoryMeta(historyDir(confPath), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreGeneration(confPath, meta); err != nil {
+		t.Fatalf("restoreGeneration: %v", err)
+	}
+	// The rejected generation's include stays until the restored files are accepted.
+	if err := pruneIncludes(confPath); err != nil {
+		t.Fatal(err)
+	}
+
+	includes, _ := filepath.Glob(filepath.Join(dir, includeDirName, "*.conf"))
+	if len(includes) != 1 || filepath.Base(includes[0]) != "ipsum-8.conf" {
+		t.Errorf("include files = %v, want only ipsum-8.conf", includes)
+	}
+	master, _ := os.ReadFile(confPath)
+	if !strings.Contains(string(master), "include /etc/nginx/conf.d/etr.d/ipsum-8.conf;") || strings.Contains(string(master), "bad-feed") {
+		t.Errorf("unexpected blocklist.conf:\n%s", master)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HookConfig is a post-apply hook: a command or an HTTP callback run after new nginx files
+// were written, for reload targets the generator has no built-in support for (nginx under
+// systemd, HAProxy on the host, a CI pipeline).
+type HookConfig struct {
+	// Name identifies the hook in logs and notifications. Defaults to the command or the URL host.
+	Name string `json:"name"`
+	// Command is an argv run directly (never through a shell), with ETR_* environment variables
+	// describing the change.
+	Command []string `json:"command,omitempty"`
+	// URL receives the change as a JSON POST.
+	URL string `json:"url,omitempty"`
+	// SecretEnv names the environment variable holding the key that signs URL requests with
+	// HMAC-SHA256.
+	SecretEnv string `json:"secret_env,omitempty"`
+	// Timeout in seconds. Defaults to 60.
+	Timeout int `json:"timeout"`
+	// OnFailure is what a failure does: notify (default), ignore or abort.
+	OnFailure string `json:"on_failure"`
+}
+
+// Hook failure policies.
+const (
+	// hookFailureNotify logs the failure, sends a notification and carries on.
+	hookFailureNotify = "notify"
+	// hookFailureIgnore only logs the failure.
+	hookFailureIgnore = "ignore"
+	// hookFailureAbort restores the previous nginx files, sends a notification and skips the
+	// remaining hooks and every other reload target, so a hook can veto a list.
+	hookFailureAbort = "abort"
+)
+
+const (
+	defaultHookTimeout = 60 * time.Second
+	// hookSignatureHeader carries "sha256=<hex HMAC of the body>".
+	hookSignatureHeader = "X-ETR-Signature-256"
+	// hookOutputLimit caps the command output quoted in an error.
+	hookOutputLimit = 4 << 10
+)
+
+// validateHooks checks the post_apply_hooks section.
+func validateHooks(hooks []HookConfig) error {
+	for i, h := range hooks {
+		if err := validateHook(h); err != nil {
+			return fmt.Errorf("hook %d (%s): %v", i+1, hookName(h), err)
+		}
+	}
+	return nil
+}
+
+func validateHook(h HookConfig) error {
+	if (len(h.Command) > 0) == (h.URL != "") {
+		return fmt.Errorf("exactly one of command and url is required")
+	}
+	if len(h.Command) > 0 && h.Command[0] == "" {
+		return fmt.Errorf("command must start with the program to run")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q must be an http(s) URL", redactURL(h.URL))
+		}
+	}
+	if h.SecretEnv != "" {
+		if h.URL == "" {
+			return fmt.Errorf("secret_env only applies to url hooks")
+		}
+		if os.Getenv(h.SecretEnv) == "" {
+			return fmt.Errorf("secret_env %s is not set", h.SecretEnv)
+		}
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative, got %d", h.Timeout)
+	}
+	switch h.OnFailure {
+	case "", hookFailureNotify, hookFailureIgnore, hookFailureAbort:
+		return nil
+	default:
+		return fmt.Errorf("unknown on_failure %q (want %s, %s or %s)", h.OnFailure, hookFailureNotify, hookFailureIgnore, hookFailureAbort)
+	}
+}
+
+// hookName returns the configured name or one derived from the command or URL.
+func hookName(h HookConfig) string {
+	switch {
+	case h.Name != "":
+		return h.Name
+	case len(h.Command) > 0:
+		return h.Command[0]
+	}
+	if u, err := url.Parse(h.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "hook"
+}
+
+// hookEvent describes the change the hooks are run for. It is the body of URL hooks and, as
+// ETR_* variables, the environment of command hooks.
+type hookEvent struct {
+	Event         string    `json:"event"` // "update" or "rollback"
+	Time          time.Time `json:"time"`
+	Instance      string    `json:"instance,omitempty"`
+	ConfFile      string    `json:"conf_file"`
+	WhitelistFile string    `json:"whitelist_file"`
+	SHA256        string    `json:"sha256"`
+	Generation    string    `json:"generation,omitempty"` // history ID of the restored generation, for rollbacks
+	Entries       int       `json:"entries"`
+	Added         int       `json:"added"`
+	Changed       int       `json:"changed"` // entries whose source label changed
+	Removed       int       `json:"removed"`
+}
+
+// newHookEvent describes the live nginx files against the entries they replaced, as read by
+// readLiveGeoEntries before the write.
+func newHookEvent(event, confFilePath, generation string, previous map[string]string) (hookEvent, error) {
+	e := hookEvent{
+		Event:         event,
+		Time:          time.Now().UTC(),
+		Instance:      os.Getenv("INSTANCE_NAME"),
+		ConfFile:      confFilePath,
+		WhitelistFile: whitelistConfPath(confFilePath),
+		Generation:    generation,
+	}
+	digest, err := verifyChecksumFile(confFilePath)
+	if err != nil {
+		return e, err
+	}
+	e.SHA256 = digest
+	current, err := readLiveGeoEntries(confFilePath)
+	if err != nil {
+		return e, err
+	}
+	diff := diffKeyval(previous, current)
+	e.Entries, e.Added, e.Changed, e.Removed = len(current), len(diff.add), len(diff.change), len(diff.remove)
+	return e, nil
+}
+
+// environ returns the event as ETR_* environment variables.
+func (e hookEvent) environ() []string {
+	return []string{
+		"ETR_EVENT=" + e.Event,
+		"ETR_TIME=" + e.Time.Format(time.RFC3339),
+		"ETR_INSTANCE=" + e.Instance,
+		"ETR_CONF_FILE=" + e.ConfFile,
+		"ETR_WHITELIST_FILE=" + e.WhitelistFile,
+		"ETR_SHA256=" + e.SHA256,
+		"ETR_GENERATION=" + e.Generation,
+		"ETR_ENTRIES=" + strconv.Itoa(e.Entries),
+		"ETR_ADDED=" + strconv.Itoa(e.Added),
+		"ETR_CHANGED=" + strconv.Itoa(e.Changed),
+		"ETR_REMOVED=" + strconv.Itoa(e.Removed),
+	}
+}
+
+// applyHooks runs the configured hooks for a write that replaced the previous entries. It
+// returns false, after restoring the previous nginx files, when the caller must not apply the
+// list anywhere else: a hook with the abort policy failed, or the live files could not be
+// described.
+func applyHooks(hooks []HookConfig, event, confFilePath, generation string, previous map[string]string, notifiers []Notifier, subjectPrefix string) bool {
+	if len(hooks) == 0 {
+		return true
+	}
+	e, err := newHookEvent(event, confFilePath, generation, previous)
+	if err != nil {
+		msg := fmt.Sprintf("Refusing to run hooks: %v", err) + rollbackNote(confFilePath)
+		logf("%s\n", msg)
+		notify(notifiers, subjectPrefix+"Hook failed", msg)
+		return false
+	}
+	return runHooks(hooks, e, notifiers, subjectPrefix)
+}
+
+// runHooks runs the hooks in order. Every hook is attempted unless one with the abort policy
+// fails; runHooks then restores the previous nginx files and returns false, and the caller must
+// not apply the list anywhere else.
+func runHooks(hooks []HookConfig, event hookEvent, notifiers []Notifier, subjectPrefix string) bool {
+	for _, h := range hooks {
+		name := hookName(h)
+		err := runHook(h, event)
+		if err == nil {
+			logf("Hook %s succeeded.\n", name)
+			continue
+		}
+
+		msg := fmt.Sprintf("Hook %s failed: %v", name, err)
+		switch h.OnFailure {
+		case hookFailureIgnore:
+			logf("%s\n", msg)
+		case hookFailureAbort:
+			msg += "\n\nSkipped the remaining hooks and reload targets." + rollbackNote(event.ConfFile)
+			logf("%s\n", msg)
+			notify(notifiers, subjectPrefix+"Hook failed", msg)
+			return false
+		default:
+			logf("%s\n", msg)
+			notify(notifiers, subjectPrefix+"Hook failed", msg)
+		}
+	}
+	return true
+}
+
+func runHook(h HookConfig, event hookEvent) error {
+	timeout := defaultHookTimeout
+	if h.Timeout > 0 {
+		timeout = time.Duration(h.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if len(h.Command) > 0 {
+		return runCommandHook(ctx, h.Command, event)
+	}
+	return postHook(ctx, h.URL, os.Getenv(h.SecretEnv), event)
+}
+
+// runCommandHook runs argv with the generator's environment plus the event. Combined output is
+// included in the error, as for post-write commands.
+func runCommandHook(ctx context.Context, argv []string, event hookEvent) error {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(), event.environ()...)
+	// A child that outlives the killed command and keeps the output pipe open would otherwise
+	// block CombinedOutput past the timeout.
+	cmd.WaitDelay = hookWaitDelay
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("command %q timed out", strings.Join(argv, " "))
+	}
+	if err != nil {
+		if len(output) > hookOutputLimit {
+			output = output[len(output)-hookOutputLimit:]
+		}
+		if trimmed := strings.TrimSpace(string(output)); trimmed != "" {
+			return fmt.Errorf("command %q: %v: %s", strings.Join(argv, " "), err, trimmed)
+		}
+		return fmt.Errorf("command %q: %v", strings.Join(argv, " "), err)
+	}
+	return nil
+}
+
+// hookWaitDelay bounds how long a timed-out command's output pipes may stay open. Declared as a
+// var so tests can shorten it.
+var hookWaitDelay = 5 * time.Second
+
+// hookClient calls operator-configured URLs, which are often internal on purpose, so it must
+// not go through the SSRF-guarded httpClient. Timeouts come from each hook's context.
+var hookClient = &http.Client{}
+
+// postHook POSTs the event as JSON. With a secret, the body is signed like GitHub webhooks:
+// hookSignatureHeader is "sha256=" and the hex HMAC-SHA256 of the body. The body carries the
+// event time, so a receiver can also reject replays.
+func postHook(ctx context.Context, hookURL, secret string, event hookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "etr/"+version)
+	if secret != "" {
+		req.Header.Set(hookSignatureHeader, signHookBody(secret, body))
+	}
+
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("POST %s: %v", redactURL(hookURL), err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", redactURL(hookURL), resp.Status)
+	}
+	return nil
+}
+
+func signHookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
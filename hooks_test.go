@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hookTestFiles writes a blocklist to replace previous and returns its path.
+func hookTestFiles(t *testing.T) string {
+	t.Helper()
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	blocklist := map[string][]string{
+		"192.0.2.1":      {"ipsum-8"},
+		"192.0.2.2":      {"compromised-ips"},
+		"203.0.113.0/24": {"local_blocklist"},
+	}
+	if err := writeBlocklistFile(nil, blocklist, confPath); err != nil {
+		t.Fatal(err)
+	}
+	return confPath
+}
+
+var hookTestPrevious = map[string]string{
+	"192.0.2.1":    "ipsum-8",
+	"192.0.2.2":    "ipsum-8",
+	"198.51.100.7": "ipsum-8",
+}
+
+func TestCommandHookEnvironment(t *testing.T) {
+	confPath := hookTestFiles(t)
+	out := filepath.Join(t.TempDir(), "env")
+	hooks := []HookConfig{{
+		Name:    "dump",
+		Command: []string{"sh", "-c", `echo "$ETR_EVENT $ETR_GENERATION $ETR_ENTRIES +$ETR_ADDED ~$ETR_CHANGED -$ETR_REMOVED $ETR_SHA256" > "$0"`, out},
+	}}
+	if !applyHooks(hooks, "update", confPath, "20260101T000000Z", hookTestPrevious, nil, "") {
+		t.Fatal("applyHooks reported an abort")
+	}
+
+	digest, err := verifyChecksumFile(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "update 20260101T000000Z 3 +1 ~1 -1 " + digest + "\n"
+	if string(got) != want {
+		t.Errorf("hook saw %q, want %q", got, want)
+	}
+}
+
+func TestURLHookSignsBody(t *testing.T) {
+	t.Setenv("ETR_TEST_HOOK_SECRET", "s3cret")
+	var event hookEvent
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature = r.Header.Get(hookSignatureHeader)
+		if !hmac.Equal([]byte(signature), []byte(signHookBody("s3cret", body))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.Unmarshal(body, &event)
+	}))
+	defer server.Close()
+
+	confPath := hookTestFiles(t)
+	hooks := []HookConfig{{URL: server.URL, SecretEnv: "ETR_TEST_HOOK_SECRET", OnFailure: hookFailureAbort}}
+	if err := validateHooks(hooks); err != nil {
+		t.Fatal(err)
+	}
+	if !applyHooks(hooks, "rollback", confPath, "", hookTestPrevious, nil, "") {
+		t.Fatalf("signed hook failed, signature %q", signature)
+	}
+	if !strings.HasPrefix(signature, "sha256=") {
+		t.Errorf("signature = %q, want a sha256= prefix", signature)
+	}
+	if event.Event != "rollback" || event.Entries != 3 || event.Removed != 1 || event.ConfFile != confPath {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestHookFailurePolicies(t *testing.T) {
+	confPath := hookTestFiles(t)
+	marker := filepath.Join(t.TempDir(), "ran")
+	touch := HookConfig{Name: "touch", Command: []string{"touch", marker}}
+
+	tests := []struct {
+		name      string
+		policy    string
+		wantApply bool
+		wantRan   bool
+	}{
+		{name: "notify carries on", policy: hookFailureNotify, wantApply: true, wantRan: true},
+		{name: "ignore carries on", policy: hookFailureIgnore, wantApply: true, wantRan: true},
+		{name: "abort stops", policy: hookFailureAbort, wantApply: false, wantRan: false},
+	}
+	for _, tt := range tests {
+		os.Remove(marker)
+		hooks := []HookConfig{{Name: "fail", Command: []string{"false"}, OnFailure: tt.policy}, touch}
+		if got := applyHooks(hooks, "update", confPath, "", nil, nil, ""); got != tt.wantApply {
+			t.Errorf("%s: applyHooks = %v, want %v", tt.name, got, tt.wantApply)
+		}
+		if _, err := os.Stat(marker); (err == nil) != tt.wantRan {
+			t.Errorf("%s: later hook ran = %v, want %v", tt.name, err == nil, tt.wantRan)
+		}
+	}
+}
+
+func TestCommandHookTimeout(t *testing.T) {
+	start := time.Now()
+	err := runHook(HookConfig{Command: []string{"sleep", "10"}, Timeout: 1}, hookEvent{})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timeout took %v", elapsed)
+	}
+}
+
+func TestCommandHookTimeoutWithLingeringChild(t *testing.T) {
+	previous := hookWaitDelay
+	hookWaitDelay = 500 * time.Millisecond
+	t.Cleanup(func() { hookWaitDelay = previous })
+
+	// The background sleep inherits the output pipe and survives the kill of sh.
+	start := time.Now()
+	err := runHook(HookConfig{Command: []string{"sh", "-c", "sleep 10 & sleep 10"}, Timeout: 1}, hookEvent{})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timeout took %v", elapsed)
+	}
+}
+
+func TestHookAbortRestoresPreviousFiles(t *testing.T) {
+	confPath := hookTestFiles(t)
+	previous, err := os.ReadFile(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeBlocklistFile(nil, map[string][]string{"198.51.100.7": {"ipsum-8"}}, confPath); err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := []HookConfig{{Name: "veto", Command: []string{"false"}, OnFailure: hookFailureAbort}}
+	if applyHooks(hooks, "update", confPath, "", nil, nil, "") {
+		t.Fatal("applyHooks ignored the abort")
+	}
+	got, err := os.ReadFile(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(previous) {
+		t.Errorf("blocklist.conf after abort:\n%s\nwant the previous version:\n%s", got, previous)
+	}
+	if _, err := verifyChecksumFile(confPath); err != nil {
+		t.Errorf("restored file fails its checksum: %v", err)
+	}
+}
+
+func TestValidateHooks(t *testing.T) {
+	t.Setenv("ETR_TEST_HOOK_SECRET", "s3cret")
+	tests := []struct {
+		name    string
+		hook    HookConfig
+		wantErr bool
+	}{
+		{name: "command", hook: HookConfig{Command: []string{"systemctl", "reload", "nginx"}}},
+		{name: "signed url", hook: HookConfig{URL: "https://ci.example.com/hooks/etr", SecretEnv: "ETR_TEST_HOOK_SECRET", OnFailure: hookFailureIgnore}},
+		{name: "neither", hook: HookConfig{}, wantErr: true},
+		{name: "both", hook: HookConfig{Command: []string{"true"}, URL: "https://example.com"}, wantErr: true},
+		{name: "not http", hook: HookConfig{URL: "ftp://example.com"}, wantErr: true},
+		{name: "unset secret", hook: HookConfig{URL: "https://example.com", SecretEnv: "ETR_TEST_HOOK_UNSET"}, wantErr: true},
+		{name: "negative timeout", hook: HookConfig{Command: []string{"true"}, Timeout: -1}, wantErr: true},
+		{name: "unknown policy", hook: HookConfig{Command: []string{"true"}, OnFailure: "retry"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateHooks([]HookConfig{tt.hook}); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Layouts for blocklist.conf, selected by nginx_geo_layout.
+const (
+	geoLayoutSingle    = "single"
+	geoLayoutPerSource = "per_source"
+)
+
+// includeDirName is the directory next to blocklist.conf holding the per-source include files.
+// nginx's default "include conf.d/*.conf" does not descend into it, so the files are only
+// loaded through the include directives inside the geo block.
+const includeDirName = "etr.d"
+
+// defaultNginxIncludeDir is where nginx sees includeDirName with the standard conf.d mount.
+const defaultNginxIncludeDir = "/etc/nginx/conf.d/" + includeDirName
+
+var (
+	validNginxIncludeDir = regexp.MustCompile(`^/[a-zA-Z0-9._/-]+$`)
+	unsafeFileNameChars  = regexp.MustCompile(`[^a-zA-Z0-9._+-]`)
+)
+
+// validateGeoLayout checks nginx_geo_layout and nginx_include_dir. The include directory is
+// embedded in nginx config, so it is restricted to plain absolute paths.
+func validateGeoLayout(layout, nginxIncludeDir string) error {
+	switch layout {
+	case "", geoLayoutSingle:
+		return nil
+	case geoLayoutPerSource:
+	default:
+		return fmt.Errorf("unknown nginx_geo_layout %q (want single or per_source)", layout)
+	}
+	if nginxIncludeDir != "" && !validNginxIncludeDir.MatchString(nginxIncludeDir) {
+		return fmt.Errorf("nginx_include_dir %q must be an absolute path of [a-zA-Z0-9._/-]", nginxIncludeDir)
+	}
+	return nil
+}
+
+// includeFileName maps a label to its include file name, e.g. "ipsum-8" → "ipsum-8.conf".
+func includeFileName(label string) string {
+	name := unsafeFileNameChars.ReplaceAllString(label, "_")
+	if name == "" || name[0] == '.' {
+		name = "_" + name
+	}
+	return name + ".conf"
+}
+
+// renderPerSourceGeoFiles renders the per-source layout: one include file per label under
+// etr.d/, and a blocklist.conf whose geo block includes them all. Carving has already been done
+// globally, so the files never overlap. An address listed by several sources carries the joined
+// label and lives in that combination's file (e.g. "ipsum-8+compromised-ips.conf"): commenting
+// out a source's own file only unblocks the addresses no other source lists.
+func renderPerSourceGeoFiles(gen *generation, confFilePath, nginxIncludeDir string) ([]byte, []renderedFile, error) {
+	if nginxIncludeDir == "" {
+		nginxIncludeDir = defaultNginxIncludeDir
+	}
+	dir := filepath.Join(filepath.Dir(confFilePath), includeDirName)
+
+	byFile := make(map[string][]blocklistEntry)
+	for _, e := range gen.entries {
+		name := includeFileName(e.label)
+		byFile[name] = append(byFile[name], e)
+	}
+	names := make([]string, 0, len(byFile))
+	for name := range byFile {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	includes := make([]renderedFile, 0, len(names))
+	for _, name := range names {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "# %s/%s — included by blocklist.conf; overwritten on every run.\n", includeDirName, name)
+		writeGeoEntries(&b, byFile[name])
+		includes = append(includes, renderedFile{path: filepath.Join(dir, name), content: b.Bytes()})
+	}
+
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = path.Join(nginxIncludeDir, name)
+	}
+	master, err := renderGeoMaster(gen, nil, paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	return master, includes, nil
+}
+
+// writePerSourceGeoFiles writes the per-source layout. Include files are written first, so
+// blocklist.conf never references a missing file; stale ones are left for pruneIncludes.
+func writePerSourceGeoFiles(gen *generation, filePath, nginxIncludeDir string) error {
+	if err := validateConfFilePath(filePath); err != nil {
+		return fmt.Errorf("refusing to write blocklist: %v", err)
+	}
+	master, includes, err := renderPerSourceGeoFiles(gen, filePath, nginxIncludeDir)
+	if err != nil {
+		return err
+	}
+	return writePerSourceFiles(filePath, master, includes)
+}
+
+// writePerSourceFiles backs up the live include files, then writes rendered include files under
+// etr.d/ and the master. Include files that are no longer part of the layout stay until
+// pruneIncludes, so rollbackNginxFiles can still restore the previous set.
+func writePerSourceFiles(filePath string, master []byte, includes []renderedFile) error {
+	if err := keepIncludeBackup(filePath); err != nil {
+		return fmt.Errorf("failed to back up include files: %v", err)
+	}
+	dir := filepath.Join(filepath.Dir(filePath), includeDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	for _, f := range includes {
+		if err := writeFileAtomic(f.path, f.content); err != nil {
+			return fmt.Errorf("failed to write include file %s: %v", f.path, err)
+		}
+	}
+	return writeGeoMaster(filePath, master)
+}
+
+// includeBackupDirName is the directory next to etr.d holding the include files that
+// blocklist.conf.bak references.
+const includeBackupDirName = includeDirName + ".bak"
+
+// includeNames returns the base names of the etr.d files a blocklist.conf includes. Commented-out
+// include lines count too, so a source disabled during an incident can still be re-enabled.
+func includeNames(master []byte) map[string]bool {
+	names := make(map[string]bool)
+	for _, line := range strings.Split(string(master), "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		if target, ok := strings.CutPrefix(line, "include "); ok {
+			// Include paths are as nginx sees them; the files live in etr.d/ next to blocklist.conf.
+			names[path.Base(strings.TrimSuffix(strings.TrimSpace(target), ";"))] = true
+		}
+	}
+	return names
+}
+
+// referencedIncludes returns the paths of the etr.d files the live blocklist.conf includes. A
+// missing blocklist.conf references none.
+func referencedIncludes(confFilePath string) ([]string, error) {
+	master, err := os.ReadFile(confFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(filepath.Dir(confFilePath), includeDirName)
+	var paths []string
+	for name := range includeNames(master) {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// keepIncludeBackup copies the include files the live blocklist.conf references to etr.d.bak, as
+// a set: they are staged in a temporary directory that replaces the previous backup. Without
+// referenced includes any old backup is removed, like keepBackup does for single files.
+func keepIncludeBackup(confFilePath string) error {
+	backup := filepath.Join(filepath.Dir(confFilePath), includeBackupDirName)
+	paths, err := referencedIncludes(confFilePath)
+	if err != nil {
+		return err
+	}
+	staging := backup + ".tmp"
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return os.RemoveAll(backup)
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	for _, p := range paths {
+		content, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Already missing from the live layout; nothing to restore it from.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(staging, filepath.Base(p)), content, 0644); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(backup); err != nil {
+		return err
+	}
+	return os.Rename(staging, backup)
+}
+
+// restoreIncludes puts back, from etr.d.bak, every include file the previous blocklist.conf
+// references, before that blocklist.conf is restored.
+func restoreIncludes(confFilePath string, master []byte) error {
+	names := includeNames(master)
+	if len(names) == 0 {
+		return nil
+	}
+	dir := filepath.Join(filepath.Dir(confFilePath), includeDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	backup := filepath.Join(filepath.Dir(confFilePath), includeBackupDirName)
+	for name := range names {
+		content, err := os.ReadFile(filepath.Join(backup, name))
+		if err != nil {
+			return fmt.Errorf("no previous %s to restore: %v", name, err)
+		}
+		if err := writeFileAtomic(filepath.Join(dir, name), content); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// pruneIncludes removes the etr.d files the live blocklist.conf no longer references. It runs
+// once the new files are final (nginx accepted them, or rollbackNginxFiles restored the old
+// ones), never before nginx -t.
+func pruneIncludes(confFilePath string) error {
+	paths, err := referencedIncludes(confFilePath)
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		keep[p] = true
+	}
+	existing, err := filepath.Glob(filepath.Join(filepath.Dir(confFilePath), includeDirName, "*.conf"))
+	if err != nil {
+		return err
+	}
+	for _, f := range existing {
+		if !keep[f] {
+			if err := os.Remove(f); err != nil {
+				logf("Failed to remove stale include file %s: %v\n", f, err)
+			}
+		}
+	}
+	return nil
+}
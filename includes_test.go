@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePerSourceGeoFiles(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "blocklist.conf")
+	gen := &generation{entries: []blocklistEntry{
+		{addr: "192.0.2.1", label: "ipsum-8"},
+		{addr: "192.0.2.2", label: "ipsum-8+compromised-ips"},
+		{addr: "198.51.100.0/24", label: "ipsum-8"},
+	}}
+
+	// A file left over from a source that is no longer listed is removed by pruneIncludes.
+	stale := filepath.Join(dir, includeDirName, "old-feed.conf")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("    203.0.113.1    old-feed;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePerSourceGeoFiles(gen, confPath, "/etc/nginx/conf.d/etr.d"); err != nil {
+		t.Fatalf("writePerSourceGeoFiles: %v", err)
+	}
+
+	master, err := os.ReadFile(confPath)
+	if err != nil {
+		t.Fatalf("read master: %v", err)
+	}
+	for _, want := range []string{
+		"# blocklist.conf\n\n",
+		"geo $blocked_source {\n    default        \"\";\n\n",
+		"    include /etc/nginx/conf.d/etr.d/ipsum-8+compromised-ips.conf;\n    include /etc/nginx/conf.d/etr.d/ipsum-8.conf;\n\n}",
+	} {
+		if !strings.Contains(string(master), want) {
+			t.Errorf("master missing %q:\n%s", want, master)
+		}
+	}
+	if strings.Contains(string(master), "192.0.2.1") {
+		t.Errorf("entries belong in the include files, not the master:\n%s", master)
+	}
+
+	ipsum, err := os.ReadFile(filepath.Join(dir, includeDirName, "ipsum-8.conf"))
+	if err != nil {
+		t.Fatalf("read include: %v", err)
+	}
+	if !strings.HasSuffix(string(ipsum), "\n    192.0.2.1    ipsum-8;\n    198.51.100.0/24    ipsum-8;\n") {
+		t.Errorf("unexpected include file:\n%s", ipsum)
+	}
+
+	if _, err := verifyChecksumFile(confPath); err != nil {
+		t.Errorf("master checksum: %v", err)
+	}
+
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("stale include file should be kept until pruneIncludes: %v", err)
+	}
+	if err := pruneIncludes(confPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale include file should be removed, stat err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, includeDirName, "ipsum-8.conf")); err != nil {
+		t.Errorf("referenced include file was pruned: %v", err)
+	}
+}
+
+func TestRollbackNginxFilesPerSource(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "blocklist.conf")
+	writeLabel := func(label, addr string) {
+		t.Helper()
+		gen := &generation{entries: []blocklistEntry{{addr: addr, label: label}}}
+		if err := writePerSourceGeoFiles(gen, confPath, defaultNginxIncludeDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLabel("a", "192.0.2.1")
+	if err := pruneIncludes(confPath); err != nil {
+		t.Fatal(err)
+	}
+	writeLabel("b", "198.51.100.1")
+
+	// nginx -t rejected the second write.
+	if err := rollbackNginxFiles(confPath); err != nil {
+		t.Fatalf("rollbackNginxFiles: %v", err)
+	}
+
+	master, err := os.ReadFile(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(master), "include /etc/nginx/conf.d/etr.d/a.conf;") {
+		t.Fatalf("master not rolled back:\n%s", master)
+	}
+	a, err := os.ReadFile(filepath.Join(dir, includeDirName, "a.conf"))
+	if err != nil {
+		t.Fatalf("the restored master includes a missing a.conf: %v", err)
+	}
+	if !strings.Contains(string(a), "192.0.2.1    a;") {
+		t.Errorf("unexpected a.conf:\n%s", a)
+	}
+	if _, err := os.Stat(filepath.Join(dir, includeDirName, "b.conf")); !os.IsNotExist(err) {
+		t.Errorf("b.conf of the rejected write should be removed, stat err = %v", err)
+	}
+	if _, err := verifyChecksumFile(confPath); err != nil {
+		t.Errorf("checksum sidecar should match the restored file: %v", err)
+	}
+	live, err := readLiveGeoEntries(confPath)
+	if err != nil || len(live) != 1 || live["192.0.2.1"] != "a" {
+		t.Errorf("live entries = %v, %v", live, err)
+	}
+}
+
+func TestRollbackNginxFilesRestoresOverwrittenInclude(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "blocklist.conf")
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		gen := &generation{entries: []blocklistEntry{{addr: addr, label: "a"}}}
+		if err := writePerSourceGeoFiles(gen, confPath, defaultNginxIncludeDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rollbackNginxFiles(confPath); err != nil {
+		t.Fatalf("rollbackNginxFiles: %v", err)
+	}
+	live, err := readLiveGeoEntries(confPath)
+	if err != nil || len(live) != 1 || live["192.0.2.1"] != "a" {
+		t.Errorf("a.conf not restored to the previous contents: %v, %v", live, err)
+	}
+}
+
+func TestIncludeFileName(t *testing.T) {
+	tests := map[string]string{
+		"ipsum-8":                 "ipsum-8.conf",
+		"ipsum-8+compromised-ips": "ipsum-8+compromised-ips.conf",
+		"../etc/passwd":           "_.._etc_passwd.conf",
+		"a b;c":                   "a_b_c.conf",
+	}
+	for label, want := range tests {
+		if got := includeFileName(label); got != want {
+			t.Errorf("includeFileName(%q) = %q, want %q", label, got, want)
+		}
+	}
+}
+
+func TestValidateGeoLayout(t *testing.T) {
+	if err := validateGeoLayout("", ""); err != nil {
+		t.Errorf("default layout: %v", err)
+	}
+	if err := validateGeoLayout(geoLayoutPerSource, "/etc/nginx/conf.d/etr.d"); err != nil {
+		t.Errorf("per_source layout: %v", err)
+	}
+	if err := validateGeoLayout("split", ""); err == nil {
+		t.Error("expected an error for an unknown layout")
+	}
+	if err := validateGeoLayout(geoLayoutPerSource, "/etc/nginx; evil"); err == nil {
+		t.Error("expected an error for an include dir that is unsafe to embed in nginx config")
+	}
+}
+
+func TestNginxFilesUnchangedPerSource(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "blocklist.conf")
+	gen := &generation{entries: []blocklistEntry{
+		{addr: "192.0.2.1", label: "ipsum-8"},
+		{addr: "198.51.100.0/24", label: "compromised-ips"},
+	}}
+	if err := writePerSourceGeoFiles(gen, confPath, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeWhitelistFile(nil, whitelistConfPath(confPath)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !nginxFilesUnchanged(gen, confPath, geoLayoutPerSource, "") {
+		t.Fatal("freshly written files should count as unchanged")
+	}
+
+	// A stale include file counts as a change, so the next write removes it.
+	extra := filepath.Join(dir, includeDirName, "old-feed.conf")
+	if err := os.WriteFile(extra, []byte("    203.0.113.1    old-feed;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if nginxFilesUnchanged(gen, confPath, geoLayoutPerSource, "") {
+		t.Error("a stale include file must count as a change")
+	}
+}
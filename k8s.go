@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+)
+
+// k8sDefaultMaxEntries caps the CIDRs per generated object. At ~50 bytes per YAML line this keeps
+// objects far below etcd's 1.5 MiB request limit and Calico/Cilium's practical sizes.
+const k8sDefaultMaxEntries = 10000
+
+// k8sLabelKey labels every generated object with the output name so policies can select all
+// parts of a split list at once.
+const k8sLabelKey = "etr-blocklist"
+
+// validK8sName is an RFC 1123 label; object names are "<name>-blocklist-<n>".
+var validK8sName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// renderCalico renders Calico GlobalNetworkSet manifests "<name>-blocklist-<n>", each labelled
+// etr-blocklist: <name>, so a GlobalNetworkPolicy can deny them all with
+// selector: etr-blocklist == "<name>".
+func renderCalico(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	return renderK8sSets(out, gen, "projectcalico.org/v3", "GlobalNetworkSet", "nets")
+}
+
+// renderCilium renders CiliumCIDRGroup manifests "<name>-blocklist-<n>" for use in
+// fromCIDRSet/ingressDeny rules via cidrGroupRef or cidrGroupSelector.
+func renderCilium(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	return renderK8sSets(out, gen, "cilium.io/v2alpha1", "CiliumCIDRGroup", "externalCIDRs")
+}
+
+// renderK8sSets writes one multi-document YAML file of CIDR-list objects, splitting the list
+// into objects of at most max_entries CIDRs. At least one object is always written so that
+// policies selecting it keep resolving when the list is empty.
+func renderK8sSets(out OutputConfig, gen *generation, apiVersion, kind, field string) ([]renderedFile, error) {
+	name, limit, err := k8sOutputSettings(out)
+	if err != nil {
+		return nil, err
+	}
+	v4, v6 := collapseNetworks(gen.entries)
+	nets := append(v4, v6...)
+
+	var b bytes.Buffer
+	writeK8sHeader(&b)
+	for part, start := 1, 0; part == 1 || start < len(nets); part, start = part+1, start+limit {
+		end := min(start+limit, len(nets))
+		writeK8sMetadata(&b, apiVersion, kind, name, part)
+		if end == start {
+			fmt.Fprintf(&b, "spec:\n  %s: []\n", field)
+			continue
+		}
+		fmt.Fprintf(&b, "spec:\n  %s:\n", field)
+		for _, n := range nets[start:end] {
+			fmt.Fprintf(&b, "    - %q\n", n.String())
+		}
+	}
+
+	return []renderedFile{{path: out.Path, content: b.Bytes()}}, nil
+}
+
+// ipBlockPeer is one NetworkPolicy ipBlock: an allowed CIDR minus the blocked networks in it.
+type ipBlockPeer struct {
+	cidr   *net.IPNet
+	except []*net.IPNet
+}
+
+// renderNetworkPolicy renders standard networking.k8s.io/v1 NetworkPolicies that allow ingress
+// from everywhere except the blocked networks, using ipBlock.except.
+//
+// NetworkPolicies only ever add allowed traffic, so a long except list cannot simply be cut into
+// several policies: each would allow what the others exclude. Instead the address space itself
+// is halved until every part holds at most max_entries blocked networks; each part becomes an
+// ipBlock over that part's CIDR, and the ipBlocks are packed into policies. The union of all
+// policies is then exactly "everything except the blocklist".
+func renderNetworkPolicy(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	name, limit, err := k8sOutputSettings(out)
+	if err != nil {
+		return nil, err
+	}
+	v4, v6 := collapseNetworks(gen.entries)
+	_, all4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, all6, _ := net.ParseCIDR("::/0")
+	all4.IP = all4.IP.To4()
+	peers := append(partitionIPBlocks(all4, v4, limit), partitionIPBlocks(all6, v6, limit)...)
+
+	// Pack peers into policies without exceeding the limit on except entries per policy.
+	var policies [][]ipBlockPeer
+	var current []ipBlockPeer
+	count := 0
+	for _, p := range peers {
+		if len(current) > 0 && count+len(p.except) > limit {
+			policies = append(policies, current)
+			current, count = nil, 0
+		}
+		current = append(current, p)
+		count += len(p.except)
+	}
+	if len(current) > 0 || len(policies) == 0 {
+		policies = append(policies, current)
+	}
+
+	var b bytes.Buffer
+	writeK8sHeader(&b)
+	b.WriteString("# Pods selected by these policies only accept ingress from non-blocked addresses.\n")
+	for i, policy := range policies {
+		writeK8sMetadata(&b, "networking.k8s.io/v1", "NetworkPolicy", name, i+1)
+		b.WriteString("spec:\n  podSelector: {}\n  policyTypes:\n    - Ingress\n")
+		if len(policy) == 0 {
+			// The blocklist covers every address; an empty ingress list denies all.
+			b.WriteString("  ingress: []\n")
+			continue
+		}
+		b.WriteString("  ingress:\n    - from:\n")
+		for _, p := range policy {
+			fmt.Fprintf(&b, "        - ipBlock:\n            cidr: %q\n", p.cidr.String())
+			if len(p.except) == 0 {
+				continue
+			}
+			b.WriteString("            except:\n")
+			for _, n := range p.except {
+				fmt.Fprintf(&b, "              - %q\n", n.String())
+			}
+		}
+	}
+
+	return []renderedFile{{path: out.Path, content: b.Bytes()}}, nil
+}
+
+// partitionIPBlocks covers space minus nets with ipBlocks holding at most limit except entries.
+// nets must be non-overlapping and inside space (as returned by collapseNetworks). A part that
+// is itself blocked produces no ipBlock at all.
+func partitionIPBlocks(space *net.IPNet, nets []*net.IPNet, limit int) []ipBlockPeer {
+	spaceOnes, _ := space.Mask.Size()
+	for _, n := range nets {
+		if ones, _ := n.Mask.Size(); ones == spaceOnes {
+			return nil
+		}
+	}
+	if len(nets) <= limit {
+		return []ipBlockPeer{{cidr: space, except: nets}}
+	}
+
+	low, high := splitNetwork(space)
+	var lowNets, highNets []*net.IPNet
+	for _, n := range nets {
+		if low.Contains(n.IP) {
+			lowNets = append(lowNets, n)
+		} else {
+			highNets = append(highNets, n)
+		}
+	}
+	return append(partitionIPBlocks(low, lowNets, limit), partitionIPBlocks(high, highNets, limit)...)
+}
+
+// k8sOutputSettings returns the object name prefix and the per-object entry limit.
+func k8sOutputSettings(out OutputConfig) (string, int, error) {
+	name := outputName(out)
+	if !validK8sName.MatchString(name) {
+		return "", 0, fmt.Errorf("name %q is not a valid Kubernetes object name (lowercase letters, digits and '-')", name)
+	}
+	limit := out.MaxEntries
+	if limit < 0 {
+		return "", 0, fmt.Errorf("max_entries must be positive, got %d", limit)
+	}
+	if limit == 0 {
+		limit = k8sDefaultMaxEntries
+	}
+	return name, limit, nil
+}
+
+func writeK8sHeader(b *bytes.Buffer) {
+	b.WriteString("# Generated by emerging-threats-rules; overwritten on every run.\n")
+	b.WriteString("# Objects are numbered from 1; prune stale ones when the list shrinks.\n")
+}
+
+func writeK8sMetadata(b *bytes.Buffer, apiVersion, kind, name string, part int) {
+	fmt.Fprintf(b, "---\napiVersion: %s\nkind: %s\nmetadata:\n", apiVersion, kind)
+	fmt.Fprintf(b, "  name: %s-blocklist-%d\n  labels:\n    %s: %s\n", name, part, k8sLabelKey, name)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRenderCalicoSplitsLargeLists(t *testing.T) {
+	gen := &generation{entries: []blocklistEntry{
+		{addr: "192.0.2.1", label: "a"},
+		{addr: "198.51.100.0/24", label: "a"},
+		{addr: "2001:db8::1", label: "b"},
+	}}
+
+	files, err := renderCalico(OutputConfig{Path: "etr-calico.yaml", MaxEntries: 2}, gen)
+	if err != nil {
+		t.Fatalf("renderCalico: %v", err)
+	}
+	got := string(files[0].content)
+
+	for _, want := range []string{
+		"apiVersion: projectcalico.org/v3\nkind: GlobalNetworkSet\n",
+		"  name: etr-blocklist-1\n  labels:\n    etr-blocklist: etr\n",
+		"spec:\n  nets:\n    - \"192.0.2.1/32\"\n    - \"198.51.100.0/24\"\n---\n",
+		"  name: etr-blocklist-2\n",
+		"    - \"2001:db8::1/128\"\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, "---\n"); n != 2 {
+		t.Errorf("expected 2 objects, got %d:\n%s", n, got)
+	}
+}
+
+func TestRenderCiliumEmpty(t *testing.T) {
+	files, err := renderCilium(OutputConfig{Path: "etr-cilium.yaml", Name: "edge"}, &generation{})
+	if err != nil {
+		t.Fatalf("renderCilium: %v", err)
+	}
+	got := string(files[0].content)
+
+	if !strings.Contains(got, "kind: CiliumCIDRGroup\n") || !strings.Contains(got, "  name: edge-blocklist-1\n") {
+		t.Errorf("unexpected output:\n%s", got)
+	}
+	if !strings.Contains(got, "spec:\n  externalCIDRs: []\n") {
+		t.Errorf("empty list should still produce one object:\n%s", got)
+	}
+}
+
+func TestRenderK8sRejectsInvalidName(t *testing.T) {
+	if _, err := renderCalico(OutputConfig{Path: "x.yaml", Name: "ETR_list"}, &generation{}); err == nil {
+		t.Error("expected an error for a name that is not a valid Kubernetes object name")
+	}
+}
+
+func TestRenderNetworkPolicy(t *testing.T) {
+	gen := &generation{entries: []blocklistEntry{
+		{addr: "192.0.2.1", label: "a"},
+		{addr: "2001:db8::/32", label: "b"},
+	}}
+
+	files, err := renderNetworkPolicy(OutputConfig{Path: "etr-netpol.yaml"}, gen)
+	if err != nil {
+		t.Fatalf("renderNetworkPolicy: %v", err)
+	}
+	got := string(files[0].content)
+
+	for _, want := range []string{
+		"apiVersion: networking.k8s.io/v1\nkind: NetworkPolicy\n",
+		"spec:\n  podSelector: {}\n  policyTypes:\n    - Ingress\n",
+		"        - ipBlock:\n            cidr: \"0.0.0.0/0\"\n            except:\n              - \"192.0.2.1/32\"\n",
+		"        - ipBlock:\n            cidr: \"::/0\"\n            except:\n              - \"2001:db8::/32\"\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestPartitionIPBlocksPreservesCoverage(t *testing.T) {
+	var blocked []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "192.0.2.1/32", "198.51.100.0/24", "203.0.113.128/25"} {
+		blocked = append(blocked, parseNetwork(cidr))
+	}
+	all := parseNetwork("0.0.0.0/0")
+
+	peers := partitionIPBlocks(all, blocked, 1)
+
+	for _, p := range peers {
+		if len(p.except) > 1 {
+			t.Errorf("ipBlock %s has %d except entries, limit is 1", p.cidr, len(p.except))
+		}
+		for _, ex := range p.except {
+			if !p.cidr.Contains(ex.IP) || ex.String() == p.cidr.String() {
+				t.Errorf("except %s is not a strict subset of %s", ex, p.cidr)
+			}
+		}
+	}
+
+	allowed := func(ip net.IP) bool {
+		for _, p := range peers {
+			if !p.cidr.Contains(ip) {
+				continue
+			}
+			for _, ex := range p.except {
+				if ex.Contains(ip) {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":      false,
+		"192.0.2.1":     false,
+		"192.0.2.2":     true,
+		"198.51.100.77": false,
+		"203.0.113.1":   true,
+		"203.0.113.200": false,
+		"8.8.8.8":       true,
+	} {
+		if got := allowed(net.ParseIP(ip)); got != want {
+			t.Errorf("allowed(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
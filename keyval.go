@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyvalConfig selects the keyval reload target: the live entries are pushed into a key-value
+// store over HTTP instead of reloading nginx.
+//
+// The endpoint contract is the one of NGINX Plus's API for a keyval zone
+// (/api/<version>/http/keyvals/<zone>), so examples/openresty implements the same contract on a
+// shared dict:
+//
+//	GET    → 200, a JSON object of every key → value
+//	POST   → add the keys of a JSON object; fails if any key already exists
+//	PATCH  → set the keys of a JSON object; a null value deletes the key
+//
+// Keys are the IPs/CIDRs of blocklist.conf and values their $blocked_source labels.
+type KeyvalConfig struct {
+	// URL of the zone, e.g. "http://nginx-plus:8080/api/9/http/keyvals/etr_blocklist".
+	// Credentials in the URL are sent as basic auth.
+	URL string `json:"url"`
+	// BatchSize caps the keys per POST/PATCH request (default 1000), keeping each request
+	// under the API location's client_max_body_size.
+	BatchSize int `json:"batch_size"`
+}
+
+const (
+	defaultKeyvalBatchSize = 1000
+	keyvalTimeout          = 60 * time.Second
+)
+
+// keyvalClient talks to an internal API on purpose, so it must not go through the SSRF-guarded
+// httpClient.
+var keyvalClient = &http.Client{Timeout: keyvalTimeout}
+
+// validateKeyvalConfig checks the nginx_keyval section.
+func validateKeyvalConfig(k *KeyvalConfig) error {
+	if k == nil {
+		return nil
+	}
+	u, err := url.Parse(k.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q must be an http(s) URL", k.URL)
+	}
+	if k.BatchSize < 0 {
+		return fmt.Errorf("batch_size must not be negative, got %d", k.BatchSize)
+	}
+	return nil
+}
+
+// keyvalDiff is what it takes to turn the zone's current content into the desired one.
+type keyvalDiff struct {
+	add    map[string]string
+	change map[string]string
+	remove []string
+}
+
+func diffKeyval(current, desired map[string]string) keyvalDiff {
+	diff := keyvalDiff{add: map[string]string{}, change: map[string]string{}}
+	for key, value := range desired {
+		old, ok := current[key]
+		switch {
+		case !ok:
+			diff.add[key] = value
+		case old != value:
+			diff.change[key] = value
+		}
+	}
+	for key := range current {
+		if _, ok := desired[key]; !ok {
+			diff.remove = append(diff.remove, key)
+		}
+	}
+	sort.Strings(diff.remove)
+	return diff
+}
+
+// pushKeyval brings the zone in line with the live blocklist files. The zone's own content is
+// the previous generation: diffing against it, rather than against local state, also repairs a
+// zone that was emptied by an nginx restart without a state file. Removals go first to free zone
+// memory for the additions.
+func pushKeyval(k *KeyvalConfig, confFilePath string) error {
+	desired, err := readLiveGeoEntries(confFilePath)
+	if err != nil {
+		return fmt.Errorf("read live blocklist: %v", err)
+	}
+	current, err := getKeyval(k.URL)
+	if err != nil {
+		return err
+	}
+	diff := diffKeyval(current, desired)
+
+	batchSize := k.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultKeyvalBatchSize
+	}
+	removals := make(map[string]*string, len(diff.remove))
+	for _, key := range diff.remove {
+		removals[key] = nil
+	}
+	changes := make(map[string]*string, len(diff.change))
+	for key, value := range diff.change {
+		changes[key] = &value
+	}
+	additions := make(map[string]*string, len(diff.add))
+	for key, value := range diff.add {
+		additions[key] = &value
+	}
+	for _, step := range []struct {
+		method string
+		pairs  map[string]*string
+	}{
+		{http.MethodPatch, removals},
+		{http.MethodPatch, changes},
+		{http.MethodPost, additions},
+	} {
+		for _, batch := range keyvalBatches(step.pairs, batchSize) {
+			if err := sendKeyval(k.URL, step.method, batch); err != nil {
+				return err
+			}
+		}
+	}
+
+	logf("Pushed %d entries to keyval %s: %d added, %d changed, %d removed.\n",
+		len(desired), redactURL(k.URL), len(diff.add), len(diff.change), len(diff.remove))
+	return nil
+}
+
+// keyvalBatches splits pairs into batches of at most size keys, in key order.
+func keyvalBatches(pairs map[string]*string, size int) []map[string]*string {
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var batches []map[string]*string
+	for start := 0; start < len(keys); start += size {
+		batch := make(map[string]*string, size)
+		for _, key := range keys[start:min(start+size, len(keys))] {
+			batch[key] = pairs[key]
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func getKeyval(zoneURL string) (map[string]string, error) {
+	resp, err := keyvalClient.Get(zoneURL)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %v", redactURL(zoneURL), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", redactURL(zoneURL), keyvalError(resp))
+	}
+	current := make(map[string]string)
+	if err := json.NewDecoder(resp.Body).Decode(&current); err != nil {
+		return nil, fmt.Errorf("GET %s: parse response: %v", redactURL(zoneURL), err)
+	}
+	return current, nil
+}
+
+func sendKeyval(zoneURL, method string, batch map[string]*string) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, zoneURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := keyvalClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", method, redactURL(zoneURL), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s (%d keys): %s", method, redactURL(zoneURL), len(batch), keyvalError(resp))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// keyvalError describes a failed response, using the NGINX Plus error object when present.
+func keyvalError(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var apiErr struct {
+		Error struct {
+			Code string `json:"code"`
+			Text string `json:"text"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Text != "" {
+		return fmt.Sprintf("%s: %s (%s)", resp.Status, apiErr.Error.Text, apiErr.Error.Code)
+	}
+	return resp.Status
+}
+
+// redactURL drops credentials from a URL for logs and notifications.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+// readLiveGeoEntries reads the address → label entries of the live $blocked_source geo block,
+// following the include directives of the per-source layout to the files under etr.d/. Reading
+// the files on the volume, rather than the in-memory generation, keeps keyval consistent with
+// what a reload would load, including after a rollback.
+func readLiveGeoEntries(confFilePath string) (map[string]string, error) {
+	f, err := os.Open(confFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	inBlock := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !inBlock {
+			inBlock = opensBlockedSourceGeo(line)
+			continue
+		}
+		if line == "}" {
+			return entries, nil
+		}
+		if target, ok := strings.CutPrefix(line, "include "); ok {
+			// Include paths are as nginx sees them; the files live in etr.d/ next to blocklist.conf.
+			name := path.Base(strings.TrimSuffix(target, ";"))
+			if err := readGeoInclude(filepath.Join(filepath.Dir(confFilePath), includeDirName, name), entries); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		addGeoEntry(line, entries)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s has no complete geo $blocked_source block", confFilePath)
+}
+
+// opensBlockedSourceGeo reports whether line opens the geo block setting $blocked_source,
+// with or without an explicit address variable ("geo $remote_addr $blocked_source {").
+func opensBlockedSourceGeo(line string) bool {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "geo" && fields[2] == "{":
+		return fields[1] == "$blocked_source"
+	case len(fields) == 4 && fields[0] == "geo" && fields[3] == "{":
+		return fields[2] == "$blocked_source"
+	}
+	return false
+}
+
+func readGeoInclude(filePath string, entries map[string]string) error {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		addGeoEntry(strings.TrimSpace(line), entries)
+	}
+	return nil
+}
+
+// addGeoEntry records an "<address>    <label>;" line; comments and directives are ignored.
+func addGeoEntry(line string, entries map[string]string) {
+	if line == "" || strings.HasPrefix(line, "#") || !strings.HasSuffix(line, ";") {
+		return
+	}
+	fields := strings.Fields(strings.TrimSuffix(line, ";"))
+	if len(fields) != 2 || fields[0] == "default" {
+		return
+	}
+	entries[fields[0]] = fields[1]
+}
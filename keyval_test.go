@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKeyvalZone serves one zone with the NGINX Plus keyval API semantics.
+type fakeKeyvalZone struct {
+	mu       sync.Mutex
+	entries  map[string]string
+	requests []string // "<method> <keys>"
+}
+
+func (f *fakeKeyvalZone) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(f.entries)
+		return
+	}
+	var batch map[string]*string
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.requests = append(f.requests, r.Method+" "+strings.Join(sortedKeys(batch), ","))
+
+	switch r.Method {
+	case http.MethodPost:
+		for key := range batch {
+			if _, ok := f.entries[key]; ok {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"status": 409, "text": "key already exists", "code": "KeyvalKeyExists"}})
+				return
+			}
+		}
+		for key, value := range batch {
+			f.entries[key] = *value
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodPatch:
+		for key, value := range batch {
+			if value == nil {
+				delete(f.entries, key)
+			} else {
+				f.entries[key] = *value
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func sortedKeys(batch map[string]*string) []string {
+	keys := make([]string, 0, len(batch))
+	for key := range batch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestPushKeyvalSyncsZone(t *testing.T) {
+	zone := &fakeKeyvalZone{entries: map[string]string{
+		"192.0.2.1":    "ipsum-8",     // unchanged
+		"192.0.2.2":    "ipsum-8",     // relabelled
+		"198.51.100.7": "old-source",  // no longer listed
+		"203.0.113.9":  "compromised", // no longer listed
+	}}
+	server := httptest.NewServer(zone)
+	defer server.Close()
+
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	blocklist := map[string][]string{
+		"192.0.2.1":       {"ipsum-8"},
+		"192.0.2.2":       {"compromised-ips"},
+		"203.0.113.0/24":  {"local_blocklist"},
+		"2001:db8::/32":   {"local_blocklist"},
+		"198.51.100.0/30": {"emerging-block-ips"},
+	}
+	if err := writeBlocklistFile(nil, blocklist, confPath); err != nil {
+		t.Fatal(err)
+	}
+	want, err := readLiveGeoEntries(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != len(blocklist) {
+		t.Fatalf("read %d live entries, want %d: %v", len(want), len(blocklist), want)
+	}
+
+	k := &KeyvalConfig{URL: server.URL, BatchSize: 2}
+	if err := pushKeyval(k, confPath); err != nil {
+		t.Fatalf("pushKeyval: %v", err)
+	}
+	if !reflect.DeepEqual(zone.entries, want) {
+		t.Errorf("zone = %v, want %v", zone.entries, want)
+	}
+	wantRequests := []string{
+		"PATCH 198.51.100.7,203.0.113.9",
+		"PATCH 192.0.2.2",
+		"POST 198.51.100.0/30,2001:db8::/32",
+		"POST 203.0.113.0/24",
+	}
+	if !reflect.DeepEqual(zone.requests, wantRequests) {
+		t.Errorf("requests = %q, want %q", zone.requests, wantRequests)
+	}
+
+	// A second push with nothing changed sends no updates.
+	zone.requests = nil
+	if err := pushKeyval(k, confPath); err != nil {
+		t.Fatalf("second pushKeyval: %v", err)
+	}
+	if len(zone.requests) != 0 {
+		t.Errorf("unchanged push sent %q", zone.requests)
+	}
+}
+
+func TestPushKeyvalReportsAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte("{}"))
+			return
+		}
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write([]byte(`{"error":{"status":507,"text":"insufficient memory","code":"KeyvalNoMemory"}}`))
+	}))
+	defer server.Close()
+
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	if err := writeBlocklistFile(nil, map[string][]string{"192.0.2.1": {"ipsum-8"}}, confPath); err != nil {
+		t.Fatal(err)
+	}
+	u := strings.Replace(server.URL, "http://", "http://admin:secret@", 1)
+	err := pushKeyval(&KeyvalConfig{URL: u}, confPath)
+	if err == nil || !strings.Contains(err.Error(), "insufficient memory (KeyvalNoMemory)") {
+		t.Fatalf("expected the API error text, got %v", err)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error leaks the credentials: %v", err)
+	}
+}
+
+func TestReadLiveGeoEntriesPerSource(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "blocklist.conf")
+	gen := &generation{entries: []blocklistEntry{
+		{addr: "192.0.2.1", label: "ipsum-8"},
+		{addr: "203.0.113.0/24", label: "local_blocklist"},
+	}}
+	if err := writePerSourceGeoFiles(gen, confPath, defaultNginxIncludeDir); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readLiveGeoEntries(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"192.0.2.1": "ipsum-8", "203.0.113.0/24": "local_blocklist"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+}
+
+func TestValidateKeyvalConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		k       *KeyvalConfig
+		wantErr bool
+	}{
+		{name: "unset", k: nil},
+		{name: "valid", k: &KeyvalConfig{URL: "http://nginx:8080/api/9/http/keyvals/etr_blocklist"}},
+		{name: "missing url", k: &KeyvalConfig{}, wantErr: true},
+		{name: "not http", k: &KeyvalConfig{URL: "file:///etc/passwd"}, wantErr: true},
+		{name: "negative batch", k: &KeyvalConfig{URL: "https://nginx/api", BatchSize: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateKeyvalConfig(tt.k); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
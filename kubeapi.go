@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// KubernetesConfig selects the in-cluster reload target: the nginx files are published in a
+// ConfigMap and the Deployments mounting it are rolled.
+type KubernetesConfig struct {
+	// Namespace defaults to the namespace of the pod ETR runs in.
+	Namespace string `json:"namespace"`
+	// ConfigMap receives blocklist.conf and whitelist.conf as data keys; it is created if missing.
+	ConfigMap string `json:"config_map"`
+	// Deployments get their pod template annotated with the blocklist digest, which makes the
+	// Deployment controller roll their pods.
+	Deployments []string `json:"deployments"`
+}
+
+// serviceAccountDir holds the in-cluster credentials. Declared as a var so tests can point it
+// at a temp directory.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+const (
+	// kubeTimeout caps each Kubernetes API request.
+	kubeTimeout = 30 * time.Second
+	// kubeConfigMapLimit is the API server's size limit for a ConfigMap's data.
+	kubeConfigMapLimit = 1 << 20
+	// kubeDigestAnnotation carries the blocklist digest on each Deployment's pod template.
+	kubeDigestAnnotation = "etr-blocklist/sha256"
+	// kubeManagedByLabel marks ConfigMaps created by ETR.
+	kubeManagedByLabel = "app.kubernetes.io/managed-by"
+)
+
+// validK8sSubdomain is an RFC 1123 subdomain, the format of ConfigMap and Deployment names.
+var validK8sSubdomain = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// validateKubernetesConfig checks the kubernetes section. ConfigMap volumes cannot hold the
+// etr.d/ subdirectory, so only the single-file layout can be published.
+func validateKubernetesConfig(k *KubernetesConfig, layout string) error {
+	if k == nil {
+		return nil
+	}
+	if k.ConfigMap == "" {
+		return fmt.Errorf("config_map is required")
+	}
+	if layout == geoLayoutPerSource {
+		return fmt.Errorf("nginx_geo_layout per_source cannot be published in a ConfigMap; use single")
+	}
+	if k.Namespace != "" && !validK8sName.MatchString(k.Namespace) {
+		return fmt.Errorf("namespace %q is not a valid Kubernetes namespace", k.Namespace)
+	}
+	for _, name := range append([]string{k.ConfigMap}, k.Deployments...) {
+		if len(name) > 253 || !validK8sSubdomain.MatchString(name) {
+			return fmt.Errorf("%q is not a valid Kubernetes object name", name)
+		}
+	}
+	return nil
+}
+
+// kubeClient is a minimal Kubernetes API client: just the two requests ETR needs, which keeps
+// client-go and its dependency tree out of the binary.
+type kubeClient struct {
+	baseURL    string
+	token      string
+	namespace  string
+	httpClient *http.Client
+}
+
+// newInClusterKubeClient builds a client from the pod's service account, like client-go's
+// rest.InClusterConfig.
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod (KUBERNETES_SERVICE_HOST/PORT unset)")
+	}
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("read service account token: %v", err)
+	}
+	caCert, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, fmt.Errorf("read service account namespace: %v", err)
+	}
+
+	return &kubeClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: strings.TrimSpace(string(namespace)),
+		httpClient: &http.Client{
+			Timeout:   kubeTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+		},
+	}, nil
+}
+
+// applyToKubernetes publishes the live nginx files in the ConfigMap and rolls the Deployments.
+// The files are checked against their sidecar first, as before a container reload.
+func applyToKubernetes(kube *kubeClient, k *KubernetesConfig, confFilePath string) error {
+	digest, err := verifyChecksumFile(confFilePath)
+	if err != nil {
+		return fmt.Errorf("blocklist checksum verification failed: %v", err)
+	}
+	data := make(map[string]string, 2)
+	size := 0
+	for _, path := range []string{confFilePath, whitelistConfPath(confFilePath)} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		data[filepath.Base(path)] = string(content)
+		size += len(content)
+	}
+	if size > kubeConfigMapLimit {
+		return fmt.Errorf("the nginx files total %d bytes, over the %d-byte ConfigMap limit", size, kubeConfigMapLimit)
+	}
+
+	namespace := k.Namespace
+	if namespace == "" {
+		namespace = kube.namespace
+	}
+	if err := kube.applyConfigMap(namespace, k.ConfigMap, data); err != nil {
+		return err
+	}
+	logf("Updated ConfigMap %s/%s.\n", namespace, k.ConfigMap)
+
+	var failures []string
+	for _, deployment := range k.Deployments {
+		if err := kube.annotateDeployment(namespace, deployment, kubeDigestAnnotation, digest); err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		logf("Annotated Deployment %s/%s with %s=%s.\n", namespace, deployment, kubeDigestAnnotation, digest)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d/%d Deployment(s) failed: %s", len(failures), len(k.Deployments), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// applyConfigMap replaces the ConfigMap's data with a JSON merge patch, creating the ConfigMap
+// when it does not exist yet.
+func (c *kubeClient) applyConfigMap(namespace, name string, data map[string]string) error {
+	path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/configmaps"
+	patch := map[string]any{"data": data}
+	status, err := c.do(http.MethodPatch, path+"/"+url.PathEscape(name), "application/merge-patch+json", patch)
+	if status != http.StatusNotFound {
+		if err != nil {
+			return fmt.Errorf("failed to update ConfigMap %s/%s: %v", namespace, name, err)
+		}
+		return nil
+	}
+
+	configMap := map[string]any{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": namespace,
+			"labels":    map[string]string{kubeManagedByLabel: "emerging-threats-rules"},
+		},
+		"data": data,
+	}
+	if _, err := c.do(http.MethodPost, path, "application/json", configMap); err != nil {
+		return fmt.Errorf("failed to create ConfigMap %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// annotateDeployment sets a pod template annotation. A changed value rolls the Deployment's
+// pods under its own strategy (maxUnavailable/maxSurge); an unchanged value is a no-op.
+func (c *kubeClient) annotateDeployment(namespace, name, key, value string) error {
+	patch := map[string]any{
+		"spec": map[string]any{
+			"template": map[string]any{
+				"metadata": map[string]any{
+					"annotations": map[string]string{key: value},
+				},
+			},
+		},
+	}
+	path := "/apis/apps/v1/namespaces/" + url.PathEscape(namespace) + "/deployments/" + url.PathEscape(name)
+	if _, err := c.do(http.MethodPatch, path, "application/merge-patch+json", patch); err != nil {
+		return fmt.Errorf("failed to patch Deployment %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// do sends a JSON request and returns the response status. Non-2xx responses are errors
+// carrying the message from the API server's Status object when there is one.
+func (c *kubeClient) do(method, path, contentType string, body any) (int, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var status struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(respBody, &status) == nil && status.Message != "" {
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, status.Message)
+	}
+	return resp.StatusCode, fmt.Errorf("%s", resp.Status)
+}
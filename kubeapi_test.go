@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKubeAPI records ConfigMaps and Deployment patches the way the API server would apply them.
+type fakeKubeAPI struct {
+	mu          sync.Mutex
+	configMaps  map[string]map[string]string // "<namespace>/<name>" → data
+	annotations map[string]map[string]string // "<namespace>/<deployment>" → pod template annotations
+	auth        []string
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+
+	var body struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Data map[string]string `json:"data"`
+		Spec struct {
+			Template struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 5 && parts[4] == "configmaps":
+		f.configMaps[parts[3]+"/"+body.Metadata.Name] = body.Data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPatch && len(parts) == 6 && parts[4] == "configmaps":
+		key := parts[3] + "/" + parts[5]
+		if _, ok := f.configMaps[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"kind": "Status", "message": `configmaps "` + parts[5] + `" not found`})
+			return
+		}
+		f.configMaps[key] = body.Data
+	case r.Method == http.MethodPatch && len(parts) == 7 && parts[5] == "deployments":
+		key := parts[4] + "/" + parts[6]
+		if parts[6] != "nginx" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"kind": "Status", "message": `deployments.apps "` + parts[6] + `" not found`})
+			return
+		}
+		f.annotations[key] = body.Spec.Template.Metadata.Annotations
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+	}
+}
+
+// inClusterFake starts a TLS fake API server and points the in-cluster environment at it.
+func inClusterFake(t *testing.T) *fakeKubeAPI {
+	fake := &fakeKubeAPI{configMaps: map[string]map[string]string{}, annotations: map[string]map[string]string{}}
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	for name, content := range map[string]string{"token": "test-token\n", "ca.crt": string(ca), "namespace": "edge\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := serviceAccountDir
+	serviceAccountDir = dir
+	t.Cleanup(func() { serviceAccountDir = saved })
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	t.Setenv("KUBERNETES_SERVICE_HOST", host)
+	t.Setenv("KUBERNETES_SERVICE_PORT", port)
+	return fake
+}
+
+func TestApplyToKubernetes(t *testing.T) {
+	fake := inClusterFake(t)
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	if err := writeBlocklistFile(nil, map[string][]string{"192.0.2.1": {"local_blocklist"}}, confPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeWhitelistFile(nil, whitelistConfPath(confPath)); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := verifyChecksumFile(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		t.Fatalf("newInClusterKubeClient: %v", err)
+	}
+	k := &KubernetesConfig{ConfigMap: "etr-blocklist", Deployments: []string{"nginx", "missing"}}
+
+	// The first run creates the ConfigMap; the second patches it.
+	for run := 1; run <= 2; run++ {
+		err = applyToKubernetes(kube, k, confPath)
+		if err == nil || !strings.Contains(err.Error(), `1/2 Deployment(s) failed`) || !strings.Contains(err.Error(), `deployments.apps "missing" not found`) {
+			t.Fatalf("run %d: expected only the missing Deployment to fail, got %v", run, err)
+		}
+	}
+
+	data := fake.configMaps["edge/etr-blocklist"]
+	if !strings.Contains(data["blocklist.conf"], "192.0.2.1") || !strings.Contains(data["whitelist.conf"], "geo $etr_whitelisted") {
+		t.Errorf("unexpected ConfigMap data: %v", data)
+	}
+	if got := fake.annotations["edge/nginx"][kubeDigestAnnotation]; got != digest {
+		t.Errorf("annotation = %q, want the blocklist digest %q", got, digest)
+	}
+	for _, auth := range fake.auth {
+		if auth != "Bearer test-token" {
+			t.Errorf("request sent with Authorization %q", auth)
+		}
+	}
+}
+
+func TestNewInClusterKubeClientOutsideCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := newInClusterKubeClient(); err == nil {
+		t.Error("expected an error outside a Kubernetes pod")
+	}
+}
+
+func TestValidateKubernetesConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		k       *KubernetesConfig
+		layout  string
+		wantErr bool
+	}{
+		{name: "unset", k: nil},
+		{name: "valid", k: &KubernetesConfig{Namespace: "edge", ConfigMap: "etr-blocklist", Deployments: []string{"nginx.v2"}}},
+		{name: "missing config map", k: &KubernetesConfig{}, wantErr: true},
+		{name: "per_source layout", k: &KubernetesConfig{ConfigMap: "etr"}, layout: geoLayoutPerSource, wantErr: true},
+		{name: "invalid deployment", k: &KubernetesConfig{ConfigMap: "etr", Deployments: []string{"Nginx"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateKubernetesConfig(tt.k, tt.layout); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/moby/moby/client"
@@ -19,6 +23,9 @@ var allowedConfDir = "/app/nginx/conf"
 
 // main is the entry point for the application
 func main() {
+	force := flag.Bool("force", false, "write the nginx files and reload nginx even when the blocklist is unchanged")
+	flag.Parse()
+
 	config, err := readConfig("/app/config.json")
 	if err != nil {
 		logf("Failed to read config file: %v\n", err)
@@ -47,6 +54,55 @@ func main() {
 		logf("Invalid nginx_conf_file_path in config: %v\n", err)
 		return
 	}
+	if err := validateGeoLayout(config.NginxGeoLayout, config.NginxIncludeDir); err != nil {
+		logf("Invalid nginx_geo_layout in config: %v\n", err)
+		return
+	}
+	var geoTemplate *template.Template
+	if config.NginxGeoTemplate != "" {
+		if geoTemplate, err = loadGeoTemplate(config.NginxGeoTemplate); err != nil {
+			logf("Invalid nginx_geo_template in config: %v\n", err)
+			return
+		}
+	}
+	if err := validateReloadStrategies(config.NginxReloadStrategy, config.NginxReloadStrategies); err != nil {
+		logf("Invalid nginx_reload_strategy in config: %v\n", err)
+		return
+	}
+	gate, err := newHealthGate(config.NginxHealthProbe, config.NginxHealthPort, config.NginxHealthTimeout)
+	if err != nil {
+		logf("Invalid nginx health check in config: %v\n", err)
+		return
+	}
+	if err := validateStoppedPolicy(config.NginxStoppedContainers); err != nil {
+		logf("Invalid nginx_stopped_containers in config: %v\n", err)
+		return
+	}
+	if err := validateContainerLabels(config.NginxContainerLabels, config.NginxExpectedContainers); err != nil {
+		logf("Invalid nginx_container_labels in config: %v\n", err)
+		return
+	}
+	if err := validateKubernetesConfig(config.Kubernetes, config.NginxGeoLayout); err != nil {
+		logf("Invalid kubernetes in config: %v\n", err)
+		return
+	}
+	if err := validateKeyvalConfig(config.NginxKeyval); err != nil {
+		logf("Invalid nginx_keyval in config: %v\n", err)
+		return
+	}
+	if err := validateHooks(config.PostApplyHooks); err != nil {
+		logf("Invalid post_apply_hooks in config: %v\n", err)
+		return
+	}
+	if err := validateSourceOptions(config.SourceOptions); err != nil {
+		logf("Invalid source_options in config: %v\n", err)
+		return
+	}
+
+	if flag.Arg(0) == "rollback" {
+		runRollback(config, flag.Arg(1), gate, notifiers, subjectPrefix)
+		return
+	}
 
 	whitelist := make(map[string]string)
 	for _, address := range config.LocalWhitelist {
@@ -80,6 +136,14 @@ func main() {
 			continue
 		}
 
+		// Rule feeds label each address by its rule; the label rides along as a URL fragment.
+		if opts := config.SourceOptions[url]; isRulesSource(url, opts) {
+			for address, label := range parseRules(content, opts.RuleSide) {
+				blocklist[address] = append(blocklist[address], url+"#"+label)
+			}
+			continue
+		}
+
 		addresses := parseIPAddresses(content)
 		for address := range addresses {
 			blocklist[address] = append(blocklist[address], url)
@@ -99,30 +163,253 @@ func main() {
 		}
 	}
 
-	err = writeBlocklistFile(whitelist, blocklist, config.ConfFilePath)
+	now := time.Now()
+	today := now.Format(dateLayout)
+
+	shadowFile := shadowStatePath(config.ConfFilePath)
+	shadowStates, err := loadShadowState(shadowFile)
+	if err != nil {
+		logf("Failed to read shadow state, restarting shadow evaluation: %v\n", err)
+	}
+	enforced, shadow, shadowStates := applyShadowMode(blocklist, config.SourceOptions, whitelist, shadowStates, today)
+
+	gen := &generation{
+		entries:   carveBlocklist(whitelist, enforced),
+		shadow:    carveBlocklist(whitelist, shadow),
+		whitelist: whitelist,
+		sources:   config.SourceOptions,
+
+		generatedAt:  now,
+		instance:     instanceName,
+		listed:       len(enforced),
+		sourceCounts: countSources(enforced),
+
+		geoTemplate: geoTemplate,
+	}
+
+	firstSeenFile := firstSeenPath(config.ConfFilePath)
+	firstSeen, err := loadFirstSeen(firstSeenFile)
 	if err != nil {
-		logf("Failed to write blocklist file: %v\n", err)
+		logf("Failed to read first-seen state, treating every entry as new: %v\n", err)
+	}
+	gen.firstSeen = updateFirstSeen(firstSeen, gen.entries, today)
+
+	// Render every additional output before writing anything, so a misconfigured output
+	// leaves its own live files untouched. It does not hold back the nginx files, unless it is
+	// a broken template.
+	rendered, err := renderOutputs(config.Outputs, gen)
+	var templateErr *templateOutputError
+	if errors.As(err, &templateErr) {
+		msg := fmt.Sprintf("Refusing to write anything: %v", err)
+		logf("%s\n", msg)
+		notify(notifiers, subjectPrefix+"Output update failed", msg)
 		return
 	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to render outputs: %v", err)
+		logf("%s\n", msg)
+		notify(notifiers, subjectPrefix+"Output update failed", msg)
+	}
 
-	if os.Getenv("RESTART_CONTAINERS") == "false" {
-		logf("RESTART_CONTAINERS=false: skipping container restart. Reload nginx via external cron or orchestrator.\n")
-		logf("Blocklist.conf file created successfully.\n")
+	// Rewriting identical files would only restart nginx for nothing, unless the reload targets
+	// never picked up the last ones.
+	changed := *force || !nginxFilesUnchanged(gen, config.ConfFilePath, config.NginxGeoLayout, config.NginxIncludeDir)
+	if !changed && !nginxFilesApplied(config.ConfFilePath) {
+		logf("The nginx files were not applied by the last run; writing and applying them again.\n")
+		changed = true
+	}
+	var previous map[string]string
+	if changed {
+		if len(config.PostApplyHooks) > 0 {
+			// Before a first run there are no live entries; every entry then counts as added.
+			previous, _ = readLiveGeoEntries(config.ConfFilePath)
+		}
+		if config.NginxGeoLayout == geoLayoutPerSource {
+			err = writePerSourceGeoFiles(gen, config.ConfFilePath, config.NginxIncludeDir)
+		} else {
+			err = writeGeoFile(gen, config.ConfFilePath)
+		}
+		if err != nil {
+			logf("Failed to write blocklist file: %v\n", err)
+			return
+		}
+
+		if err := writeWhitelistFile(whitelist, whitelistConfPath(config.ConfFilePath)); err != nil {
+			logf("Failed to write whitelist file: %v\n", err)
+			return
+		}
+	}
+
+	if err := saveFirstSeen(firstSeenFile, gen.firstSeen); err != nil {
+		logf("Failed to save first-seen state: %v\n", err)
+	}
+	if err := saveShadowState(shadowFile, shadowStates); err != nil {
+		logf("Failed to save shadow state: %v\n", err)
+	}
+
+	if err := writeOutputs(rendered); err != nil {
+		msg := fmt.Sprintf("Failed to apply outputs: %v", err)
+		logf("%s\n", msg)
+		notify(notifiers, subjectPrefix+"Output update failed", msg)
+	}
+	if warnings := outputWarnings(rendered); len(warnings) > 0 {
+		notify(notifiers, subjectPrefix+"Output incomplete", "Some outputs were written without part of the blocklist:\n\n"+strings.Join(warnings, "\n"))
+	}
+
+	if !changed {
+		logf("No changes to the nginx blocklist since the last run; skipped the write and the reload. Run with --force to override.\n")
+		// The zone lives in nginx's memory and can lose its content without the files changing.
+		if config.NginxKeyval != nil {
+			syncKeyval(config.NginxKeyval, config.ConfFilePath, notifiers, subjectPrefix)
+		}
 		return
 	}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		logf("Failed to create Docker client: %v\n", err)
+	if !applyNginxFiles(config, gate, "update", "", previous, notifiers, subjectPrefix) {
 		return
 	}
 
-	if err := restartNginxContainers(cli, config.NginxContainerNames); err != nil {
-		msg := fmt.Sprintf("Failed to restart nginx containers: %v", err)
+	// Only generations the reload targets accepted are worth rolling back to.
+	historyID, err := recordHistory(config.ConfFilePath, gen, config.NginxGeoLayout, config.NginxHistorySize)
+	if err != nil {
+		logf("Failed to record blocklist history: %v\n", err)
+	} else if historyID != "" {
+		logf("Recorded generation %s in the blocklist history.\n", historyID)
+	}
+}
+
+// syncKeyval pushes the live nginx files into the keyval zone and notifies on failure. It runs on
+// every run, not only when the files changed, so a zone emptied by an nginx restart is refilled.
+func syncKeyval(k *KeyvalConfig, confFilePath string, notifiers []Notifier, subjectPrefix string) bool {
+	if err := pushKeyval(k, confFilePath); err != nil {
+		msg := fmt.Sprintf("Failed to push the blocklist to keyval: %v", err)
+		logf("%s\n", msg)
+		notify(notifiers, subjectPrefix+"Keyval push failed", msg)
+		return false
+	}
+	return true
+}
+
+// applyNginxFiles makes the reload targets pick up the nginx files now on the volume. The files
+// are config-tested first (see testNginxConfig) and rolled back if nginx rejects them, so no
+// target ever receives files a rollback is about to revert. The post-apply hooks run next, for
+// event ("update" or "rollback") against the previous entries, and an aborting hook rolls the
+// files back too. Then the keyval zone is synced, the Kubernetes ConfigMap and Deployments are
+// updated, Apache is signalled, Swarm services are force-updated and every nginx container is
+// reloaded in a rolling fashion. It returns true, and records the files as applied (see
+// markApplied), only when every target picked them up.
+func applyNginxFiles(config *Config, gate healthGate, event, generation string, previous map[string]string, notifiers []Notifier, subjectPrefix string) bool {
+	// Confirm the file on the volume is exactly what this run generated before anything loads it.
+	digest, err := verifyChecksumFile(config.ConfFilePath)
+	if err != nil {
+		msg := fmt.Sprintf("Refusing to reload: blocklist checksum verification failed: %v", err)
 		logf("%s\n", msg)
 		notify(notifiers, subjectPrefix+"Nginx restart failed", msg)
-		return
+		return false
+	}
+	logf("Verified %s (sha256 %s).\n", config.ConfFilePath, digest)
+
+	// Without the Docker socket there is nowhere to run nginx -t; the files are applied untested.
+	restart := os.Getenv("RESTART_CONTAINERS") != "false"
+	var cli *client.Client
+	var nginxContainers []string
+	if restart {
+		cli, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			logf("Failed to create Docker client: %v\n", err)
+			return false
+		}
+
+		nginxContainers, err = resolveNginxContainers(cli, config.NginxContainerNames, config.NginxContainerLabels, config.NginxExpectedContainers)
+		if err != nil {
+			msg := fmt.Sprintf("Refusing to reload: %v", err)
+			logf("%s\n", msg)
+			notify(notifiers, subjectPrefix+"Nginx restart failed", msg)
+			return false
+		}
+
+		// nginx -t in the live containers is the only complete check: it also covers default.conf.
+		if err := testNginxConfig(cli, config, nginxContainers); err != nil {
+			msg := fmt.Sprintf("Refusing to reload: %v", err) + rollbackNote(config.ConfFilePath)
+			logf("%s\n", msg)
+			notify(notifiers, subjectPrefix+"Nginx config test failed", msg)
+			return false
+		}
+	}
+	// Hooks only see files nginx accepted, and an abort rolls them back before any target has them.
+	if !applyHooks(config.PostApplyHooks, event, config.ConfFilePath, generation, previous, notifiers, subjectPrefix) {
+		return false
+	}
+	if err := pruneIncludes(config.ConfFilePath); err != nil {
+		logf("Failed to remove stale include files: %v\n", err)
+	}
+
+	// The keyval zone and Kubernetes are reached over HTTP, not the Docker socket, so they are
+	// not affected by RESTART_CONTAINERS.
+	applied := true
+	if config.NginxKeyval != nil && !syncKeyval(config.NginxKeyval, config.ConfFilePath, notifiers, subjectPrefix) {
+		applied = false
+	}
+	if config.Kubernetes != nil {
+		kube, err := newInClusterKubeClient()
+		if err == nil {
+			err = applyToKubernetes(kube, config.Kubernetes, config.ConfFilePath)
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Failed to update Kubernetes: %v", err)
+			logf("%s\n", msg)
+			notify(notifiers, subjectPrefix+"Kubernetes update failed", msg)
+			applied = false
+		}
+	}
+
+	if !restart {
+		logf("RESTART_CONTAINERS=false: skipping the config test and container restart. Reload nginx via post_apply_hooks, external cron or orchestrator.\n")
+		logf("Blocklist.conf file created successfully.\n")
+		return recordApplied(config.ConfFilePath, applied)
+	}
+
+	if err := reloadApacheContainers(cli, config.ApacheContainerNames); err != nil {
+		msg := fmt.Sprintf("Failed to reload Apache containers: %v", err)
+		logf("%s\n", msg)
+		notify(notifiers, subjectPrefix+"Apache reload failed", msg)
+		applied = false
+	}
+
+	if err := updateSwarmServices(cli, config.SwarmServices); err != nil {
+		msg := fmt.Sprintf("Failed to update Swarm services: %v", err)
+		logf("%s\n", msg)
+		notify(notifiers, subjectPrefix+"Swarm update failed", msg)
+		applied = false
+	}
+
+	rollout := nginxRollout{
+		defaultStrategy: config.NginxReloadStrategy,
+		overrides:       config.NginxReloadStrategies,
+		gate:            gate,
+		stopped:         config.NginxStoppedContainers,
+	}
+	results := rollout.apply(cli, nginxContainers)
+	logf("Nginx rollout results:\n%s", results.summary())
+	if failed := results.failures(); failed > 0 {
+		msg := fmt.Sprintf("%d of %d nginx container(s) did not pick up the new blocklist:\n\n%s", failed, len(results), results.summary())
+		notify(notifiers, subjectPrefix+"Nginx restart failed", msg)
+		return false
 	}
 
 	logf("Blocklist.conf file created and Nginx containers restarted successfully.\n")
+	return recordApplied(config.ConfFilePath, applied)
+}
+
+// recordApplied marks the live nginx files as applied when every reload target succeeded, and
+// passes the outcome through. A failed target leaves the marker alone, so the next run applies
+// the files again even if the list did not change.
+func recordApplied(confFilePath string, applied bool) bool {
+	if !applied {
+		return false
+	}
+	if err := markApplied(confFilePath); err != nil {
+		logf("Failed to record the applied blocklist: %v\n", err)
+	}
+	return true
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// version is the tool version written into generated headers.
+// Release builds set it with -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// countSources counts, per source, the listed addresses it contributed (before carving).
+func countSources(blocklist map[string][]string) map[string]int {
+	counts := make(map[string]int)
+	for _, srcs := range blocklist {
+		seen := make(map[string]bool, len(srcs))
+		for _, src := range srcs {
+			key := sourceKey(src)
+			if !seen[key] {
+				seen[key] = true
+				counts[key]++
+			}
+		}
+	}
+	return counts
+}
+
+// renderGeoHeader renders the comment block that follows the "# blocklist.conf" line, recording
+// when, where and by which version the file was built, what each source contributed and what
+// the whitelist removed. Every line is a comment, so nginx ignores it.
+func renderGeoHeader(gen *generation) []byte {
+	// Entries split by the whitelist share an original; entries skipped entirely have none left.
+	originals := make(map[string]bool)
+	split := make(map[string]bool)
+	for _, e := range gen.entries {
+		originals[e.original] = true
+		if e.carveResult() == carveSplit {
+			split[e.original] = true
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated by emerging-threats-rules %s at %s", version, gen.generatedAt.Format(time.RFC3339))
+	if gen.instance != "" {
+		fmt.Fprintf(&b, " (instance %s)", gen.instance)
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "# Entries: %d networks from %d listed addresses\n", len(gen.entries), gen.listed)
+	fmt.Fprintf(&b, "# Whitelist: %d entries; %d listed address(es) split, %d skipped entirely\n",
+		len(gen.whitelist), len(split), max(gen.listed-len(originals), 0))
+
+	if len(gen.sourceCounts) > 0 {
+		sources := make([]string, 0, len(gen.sourceCounts))
+		for source := range gen.sourceCounts {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+		b.WriteString("# Sources (listed addresses):\n")
+		for _, source := range sources {
+			fmt.Fprintf(&b, "#   %7d  %s\n", gen.sourceCounts[source], source)
+		}
+	}
+	if shadowConfigured(gen.sources) {
+		fmt.Fprintf(&b, "# Shadow: %d networks in $etr_shadow_source, not enforced\n", len(gen.shadow))
+	}
+	return b.Bytes()
+}
+
+// geoBody returns a rendered blocklist.conf without its title and run header. The header
+// records when and by which run the file was generated, so it changes on every run even when
+// the list itself does not.
+func geoBody(content []byte) []byte {
+	rest := bytes.TrimPrefix(content, []byte("# blocklist.conf\n\n"))
+	for bytes.HasPrefix(rest, []byte("#")) {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			return nil
+		}
+		rest = rest[i+1:]
+	}
+	return rest
+}
+
+// checksumPath returns the sha256 sidecar location for a generated file.
+func checksumPath(filePath string) string {
+	return filePath + ".sha256"
+}
+
+// writeChecksumFile writes a sha256sum-compatible sidecar ("<hex>  <name>") for content, so
+// operators can run `sha256sum -c blocklist.conf.sha256` on the volume.
+func writeChecksumFile(filePath string, content []byte) error {
+	sum := sha256.Sum256(content)
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), filepath.Base(filePath))
+	return writeFileAtomic(checksumPath(filePath), []byte(line))
+}
+
+// verifyChecksumFile checks filePath against its sidecar and returns the verified digest.
+// The reload step uses it to confirm nginx is about to load exactly what this run generated.
+func verifyChecksumFile(filePath string) (string, error) {
+	sidecar, err := os.ReadFile(checksumPath(filePath))
+	if err != nil {
+		return "", fmt.Errorf("read checksum: %v", err)
+	}
+	fields := strings.Fields(string(sidecar))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum file %s is empty", checksumPath(filePath))
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	if got := hex.EncodeToString(sum[:]); got != fields[0] {
+		return "", fmt.Errorf("%s has sha256 %s, sidecar says %s", filePath, got, fields[0])
+	}
+	return fields[0], nil
+}
+
+// appliedPath returns the marker recording which blocklist.conf the reload targets last picked up.
+func appliedPath(filePath string) string {
+	return filePath + ".applied"
+}
+
+// markApplied records the sha256 of the live blocklist.conf once every reload target picked it
+// up, so a run whose list did not change can tell whether the previous apply failed.
+func markApplied(filePath string) error {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	return writeFileAtomic(appliedPath(filePath), []byte(hex.EncodeToString(sum[:])+"\n"))
+}
+
+// nginxFilesApplied reports whether the live blocklist.conf is the one markApplied last recorded.
+// A missing marker counts as not applied.
+func nginxFilesApplied(filePath string) bool {
+	marker, err := os.ReadFile(appliedPath(filePath))
+	if err != nil {
+		return false
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(content)
+	return strings.TrimSpace(string(marker)) == hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustRenderGeoFile renders blocklist.conf for gen, failing the test on a render error.
+func mustRenderGeoFile(t *testing.T, gen *generation) string {
+	t.Helper()
+	content, err := renderGeoFile(gen)
+	if err != nil {
+		t.Fatalf("renderGeoFile: %v", err)
+	}
+	return string(content)
+}
+
+func TestRenderGeoFileHeader(t *testing.T) {
+	whitelist := map[string]string{"198.51.100.5": "local_whitelist", "203.0.113.0/24": "local_whitelist"}
+	blocklist := map[string][]string{
+		"198.51.100.0/24": {testIpsumURL, testCompromisedURL},
+		"203.0.113.9":     {testIpsumURL},
+		"192.0.2.1":       {"local_blocklist"},
+	}
+	gen := &generation{
+		entries:      carveBlocklist(whitelist, blocklist),
+		whitelist:    whitelist,
+		generatedAt:  time.Date(2026, 3, 14, 2, 30, 0, 0, time.UTC),
+		instance:     "prod-eu",
+		listed:       len(blocklist),
+		sourceCounts: countSources(blocklist),
+	}
+
+	got := mustRenderGeoFile(t, gen)
+
+	want := "# blocklist.conf\n\n" +
+		"# Generated by emerging-threats-rules dev at 2026-03-14T02:30:00Z (instance prod-eu)\n" +
+		"# Entries: 9 networks from 3 listed addresses\n" +
+		"# Whitelist: 2 entries; 1 listed address(es) split, 1 skipped entirely\n" +
+		"# Sources (listed addresses):\n" +
+		"#         2  " + testIpsumURL + "\n" +
+		"#         1  " + testCompromisedURL + "\n" +
+		"#         1  local_blocklist\n" +
+		"\ngeo $blocked_source {\n"
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("unexpected header:\n%s\nwant prefix:\n%s", got, want)
+	}
+}
+
+func TestCountSources(t *testing.T) {
+	counts := countSources(map[string][]string{
+		"192.0.2.1": {testIpsumURL, testIpsumURL},
+		"192.0.2.2": {testIpsumURL, "https://example.com/x.rules#et-drop"},
+		"192.0.2.3": {"https://example.com/x.rules#et-compromised"},
+	})
+
+	if counts[testIpsumURL] != 2 || counts["https://example.com/x.rules"] != 2 || len(counts) != 2 {
+		t.Errorf("unexpected counts: %v", counts)
+	}
+}
+
+func TestChecksumSidecar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.conf")
+	if err := writeBlocklistFile(nil, map[string][]string{"192.0.2.1": {"test"}}, path); err != nil {
+		t.Fatalf("writeBlocklistFile: %v", err)
+	}
+
+	sidecar, err := os.ReadFile(checksumPath(path))
+	if err != nil {
+		t.Fatalf("sidecar not written: %v", err)
+	}
+	if fields := strings.Fields(string(sidecar)); len(fields) != 2 || len(fields[0]) != 64 || fields[1] != "blocklist.conf" {
+		t.Errorf("sidecar is not in sha256sum format: %q", sidecar)
+	}
+
+	digest, err := verifyChecksumFile(path)
+	if err != nil {
+		t.Fatalf("verifyChecksumFile: %v", err)
+	}
+	if !strings.HasPrefix(string(sidecar), digest) {
+		t.Errorf("digest %s does not match sidecar %q", digest, sidecar)
+	}
+
+	if err := os.WriteFile(path, []byte("# tampered\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyChecksumFile(path); err == nil {
+		t.Error("expected verification to fail after the file changed")
+	}
+}
+
+func TestNginxFilesUnchangedIgnoresRunHeader(t *testing.T) {
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	whitelist := map[string]string{"192.0.2.10": "local_whitelist"}
+	newGen := func(at time.Time, blocked string) *generation {
+		blocklist := map[string][]string{blocked: {testIpsumURL}}
+		return &generation{
+			entries:      carveBlocklist(whitelist, blocklist),
+			whitelist:    whitelist,
+			generatedAt:  at,
+			listed:       len(blocklist),
+			sourceCounts: countSources(blocklist),
+		}
+	}
+	yesterday := time.Date(2026, 3, 13, 2, 30, 0, 0, time.UTC)
+	today := yesterday.Add(24 * time.Hour)
+
+	if nginxFilesUnchanged(newGen(today, "203.0.113.9"), confPath, "", "") {
+		t.Fatal("a missing blocklist.conf must count as a change")
+	}
+	if err := writeGeoFile(newGen(yesterday, "203.0.113.9"), confPath); err != nil {
+		t.Fatal(err)
+	}
+	if nginxFilesUnchanged(newGen(today, "203.0.113.9"), confPath, "", "") {
+		t.Error("a missing whitelist.conf must count as a change")
+	}
+	if err := writeWhitelistFile(whitelist, whitelistConfPath(confPath)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !nginxFilesUnchanged(newGen(today, "203.0.113.9"), confPath, "", "") {
+		t.Error("only the run header differs; the files should count as unchanged")
+	}
+	if nginxFilesUnchanged(newGen(today, "203.0.113.10"), confPath, "", "") {
+		t.Error("a different entry must count as a change")
+	}
+}
+
+func TestNginxFilesApplied(t *testing.T) {
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	gen := &generation{entries: []blocklistEntry{{addr: "192.0.2.1", label: "ipsum-8"}}, generatedAt: time.Date(2026, 3, 14, 2, 30, 0, 0, time.UTC)}
+	if err := writeGeoFile(gen, confPath); err != nil {
+		t.Fatal(err)
+	}
+	if nginxFilesApplied(confPath) {
+		t.Fatal("files without a marker should count as not applied")
+	}
+	if err := markApplied(confPath); err != nil {
+		t.Fatal(err)
+	}
+	if !nginxFilesApplied(confPath) {
+		t.Fatal("marked files should count as applied")
+	}
+
+	// The same list written again (e.g. after a failed reload) is a new file to apply.
+	gen.generatedAt = gen.generatedAt.AddDate(0, 0, 1)
+	if err := writeGeoFile(gen, confPath); err != nil {
+		t.Fatal(err)
+	}
+	if nginxFilesApplied(confPath) {
+		t.Error("a rewritten blocklist.conf should not count as applied")
+	}
+}
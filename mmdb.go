@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// mmdbDatabaseType is recorded in the MMDB metadata so readers can tell the file apart from
+// MaxMind's own databases.
+const mmdbDatabaseType = "ETR-Blocklist"
+
+// renderMMDB renders the carved blocklist as a MaxMind DB (.mmdb) file, readable natively by the
+// maxminddb/geoip2 libraries and nginx's geoip2 module. Each network maps to a record:
+//
+//	{"blocked_source": "ipsum-8+compromised-ips", "labels": [...], "sources": [...],
+//	 "score": 2, "first_seen": "2026-03-14"}
+//
+// blocked_source matches the value nginx's geo block assigns, so geoip2 configs can reuse it.
+// Where entries overlap, the most specific network's record wins, as in the geo trie.
+func renderMMDB(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	tree, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType: mmdbDatabaseType,
+		Description:  map[string]string{"en": "Emerging Threats Rules blocklist"},
+		BuildEpoch:   time.Now().Unix(),
+		// Blocklists may legitimately contain private or documentation ranges.
+		IncludeReservedNetworks: true,
+		RecordSize:              28,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Insert wider networks first; each insert replaces the covered part of earlier ones.
+	entries := make([]blocklistEntry, len(gen.entries))
+	copy(entries, gen.entries)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return prefixLen(entries[i].addr) < prefixLen(entries[j].addr)
+	})
+
+	for _, e := range entries {
+		n := parseNetwork(e.addr)
+		if n == nil {
+			continue
+		}
+		if err := tree.Insert(n, mmdbRecord(gen, e)); err != nil {
+			return nil, fmt.Errorf("insert %s: %v", e.addr, err)
+		}
+	}
+
+	var b bytes.Buffer
+	if _, err := tree.WriteTo(&b); err != nil {
+		return nil, err
+	}
+	return []renderedFile{{path: out.Path, content: b.Bytes()}}, nil
+}
+
+func mmdbRecord(gen *generation, e blocklistEntry) mmdbtype.Map {
+	var labels, sources mmdbtype.Slice
+	for _, src := range e.sources {
+		labels = append(labels, mmdbtype.String(labelFromSource(src)))
+		sources = append(sources, mmdbtype.String(sourceKey(src)))
+	}
+	record := mmdbtype.Map{
+		"blocked_source": mmdbtype.String(e.label),
+		"labels":         labels,
+		"sources":        sources,
+		"score":          mmdbtype.Uint32(gen.score(e)),
+	}
+	if date := gen.firstSeen[e.addr]; date != "" {
+		record["first_seen"] = mmdbtype.String(date)
+	}
+	return record
+}
+
+// prefixLen returns the prefix length of an IP or CIDR string (full length for a single IP).
+func prefixLen(address string) int {
+	n := parseNetwork(address)
+	if n == nil {
+		return 0
+	}
+	ones, _ := n.Mask.Size()
+	return ones
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+type testMMDBRecord struct {
+	BlockedSource string   `maxminddb:"blocked_source"`
+	Labels        []string `maxminddb:"labels"`
+	Sources       []string `maxminddb:"sources"`
+	Score         uint32   `maxminddb:"score"`
+	FirstSeen     string   `maxminddb:"first_seen"`
+}
+
+func TestRenderMMDB(t *testing.T) {
+	ruleSource := "https://rules.emergingthreats.net/blockrules/emerging-drop.rules#et-drop-spamhaus"
+	gen := &generation{
+		entries: []blocklistEntry{
+			{addr: "198.51.100.0/24", label: "ipsum-8", sources: []string{testIpsumURL}},
+			{addr: "198.51.100.7", label: "ipsum-8+et-drop-spamhaus", sources: []string{testIpsumURL, ruleSource}},
+			{addr: "2001:db8::/32", label: "local", sources: []string{"local_blocklist"}},
+		},
+		sources:   map[string]SourceOptions{testIpsumURL: {Weight: 5}},
+		firstSeen: map[string]string{"198.51.100.0/24": "2026-01-02", "198.51.100.7": "2026-03-04"},
+	}
+
+	files, err := renderMMDB(OutputConfig{Path: "etr.mmdb"}, gen)
+	if err != nil {
+		t.Fatalf("renderMMDB: %v", err)
+	}
+	reader, err := maxminddb.OpenBytes(files[0].content)
+	if err != nil {
+		t.Fatalf("generated file is not a valid MMDB: %v", err)
+	}
+	defer reader.Close()
+
+	if reader.Metadata.DatabaseType != mmdbDatabaseType {
+		t.Errorf("database type = %q", reader.Metadata.DatabaseType)
+	}
+
+	tests := []struct {
+		ip    string
+		found bool
+		want  testMMDBRecord
+	}{
+		{
+			ip:    "198.51.100.1",
+			found: true,
+			want: testMMDBRecord{
+				BlockedSource: "ipsum-8", Labels: []string{"ipsum-8"}, Sources: []string{testIpsumURL},
+				Score: 5, FirstSeen: "2026-01-02",
+			},
+		},
+		{
+			// The more specific entry wins over the /24 it sits in.
+			ip:    "198.51.100.7",
+			found: true,
+			want: testMMDBRecord{
+				BlockedSource: "ipsum-8+et-drop-spamhaus",
+				Labels:        []string{"ipsum-8", "et-drop-spamhaus"},
+				Sources:       []string{testIpsumURL, "https://rules.emergingthreats.net/blockrules/emerging-drop.rules"},
+				Score:         6,
+				FirstSeen:     "2026-03-04",
+			},
+		},
+		{
+			ip:    "2001:db8::abcd",
+			found: true,
+			want: testMMDBRecord{
+				BlockedSource: "local", Labels: []string{"local"}, Sources: []string{"local_blocklist"}, Score: 1,
+			},
+		},
+		{ip: "203.0.113.1", found: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			result := reader.Lookup(netip.MustParseAddr(tt.ip))
+			if err := result.Err(); err != nil {
+				t.Fatalf("lookup: %v", err)
+			}
+			if result.Found() != tt.found {
+				t.Fatalf("found = %v, want %v", result.Found(), tt.found)
+			}
+			if !tt.found {
+				return
+			}
+			var got testMMDBRecord
+			if err := result.Decode(&got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("record = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"net"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -196,3 +198,70 @@ func isIPWhitelisted(ip string, whitelist map[string]string) (bool, string, stri
 
 	return false, "", ""
 }
+
+// collapseNetworks parses the carved entries and drops every network that is contained in
+// another, returning the non-overlapping IPv4 and IPv6 networks in address order.
+// Kernel firewall sets (nftables interval sets in particular) reject overlapping elements,
+// whereas the nginx geo trie simply prefers the most specific match.
+func collapseNetworks(entries []blocklistEntry) (v4, v6 []*net.IPNet) {
+	var nets []*net.IPNet
+	for _, e := range entries {
+		if n := parseNetwork(e.addr); n != nil {
+			nets = append(nets, n)
+		}
+	}
+
+	// Sort by family, then start address, then widest prefix first: any network that
+	// contains another then always sorts immediately before the networks it covers.
+	sort.Slice(nets, func(i, j int) bool {
+		if len(nets[i].IP) != len(nets[j].IP) {
+			return len(nets[i].IP) < len(nets[j].IP)
+		}
+		if c := bytes.Compare(nets[i].IP, nets[j].IP); c != 0 {
+			return c < 0
+		}
+		oi, _ := nets[i].Mask.Size()
+		oj, _ := nets[j].Mask.Size()
+		return oi < oj
+	})
+
+	var last *net.IPNet
+	for _, n := range nets {
+		if last != nil && len(last.IP) == len(n.IP) && last.Contains(n.IP) {
+			continue
+		}
+		last = n
+		if len(n.IP) == net.IPv4len {
+			v4 = append(v4, n)
+		} else {
+			v6 = append(v6, n)
+		}
+	}
+	return v4, v6
+}
+
+// expandNetwork lists every address in n, or returns nil when n holds more than limit addresses.
+func expandNetwork(n *net.IPNet, limit int) []net.IP {
+	ones, bits := n.Mask.Size()
+	if bits-ones >= 31 || 1<<(bits-ones) > limit {
+		return nil
+	}
+
+	count := 1 << (bits - ones)
+	ips := make([]net.IP, 0, count)
+	ip := make(net.IP, len(n.IP))
+	copy(ip, n.IP.Mask(n.Mask))
+	for i := 0; i < count; i++ {
+		next := make(net.IP, len(ip))
+		copy(next, ip)
+		ips = append(ips, next)
+		// Increment as a big-endian integer.
+		for j := len(ip) - 1; j >= 0; j-- {
+			ip[j]++
+			if ip[j] != 0 {
+				break
+			}
+		}
+	}
+	return ips
+}
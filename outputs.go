@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// renderedFile is one file produced by an output renderer, ready to be written atomically.
+type renderedFile struct {
+	path    string
+	content []byte
+}
+
+// generation is the result of one run that every output is rendered from.
+type generation struct {
+	entries   []blocklistEntry         // carved blocklist, sorted by address
+	shadow    []blocklistEntry         // carved matches of shadow-mode sources, not enforced
+	whitelist map[string]string        // whitelist entry → source
+	sources   map[string]SourceOptions // per-source settings from config
+	firstSeen map[string]string        // entry address → date first listed (YYYY-MM-DD)
+
+	generatedAt  time.Time      // start of the run
+	instance     string         // INSTANCE_NAME, if set
+	listed       int            // enforced addresses listed before carving
+	sourceCounts map[string]int // enforced source → addresses it listed
+
+	geoTemplate *template.Template // nginx_geo_template, if set
+}
+
+// score sums the weights of an entry's distinct sources, counting unweighted sources as 1,
+// so addresses corroborated by more (or more trusted) lists rank higher.
+func (gen *generation) score(e blocklistEntry) int {
+	score := 0
+	seen := make(map[string]bool)
+	for _, src := range e.sources {
+		key := sourceKey(src)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if w := gen.sources[key].Weight; w > 0 {
+			score += w
+		} else {
+			score++
+		}
+	}
+	return score
+}
+
+// outputRenderer renders one configured output from the run's generation.
+// Most formats return a single file at out.Path; formats with sidecars return several.
+type outputRenderer func(out OutputConfig, gen *generation) ([]renderedFile, error)
+
+// outputFormats maps the "format" field of an output to its renderer.
+var outputFormats = map[string]outputRenderer{
+	"nftables": renderNftables,
+	"ipset":    renderIpset,
+	"pf":       renderPf,
+	"caddy":    renderCaddy,
+	"traefik":  renderTraefik,
+	"apache":   renderApache,
+	"suricata": renderSuricata,
+	"mmdb":     renderMMDB,
+	"json":     renderJSON,
+	"csv":      renderCSV,
+
+	"calico":        renderCalico,
+	"cilium":        renderCilium,
+	"networkpolicy": renderNetworkPolicy,
+
+	"template": renderTemplate,
+}
+
+// renderedOutput pairs an output's configuration with the files it rendered.
+type renderedOutput struct {
+	config  OutputConfig
+	files   []renderedFile
+	warning string // set when the files are usable but incomplete; see outputWarning
+}
+
+// outputWarning is returned by a renderer whose files are usable but knowingly incomplete, e.g.
+// an Apache RewriteMap that left out wide networks on request. The files are still written and
+// the warning is sent as a notification.
+type outputWarning struct {
+	msg string
+}
+
+func (w *outputWarning) Error() string { return w.msg }
+
+// outputWarnings returns the warnings of the rendered outputs, one line per output.
+func outputWarnings(rendered []renderedOutput) []string {
+	var warnings []string
+	for _, r := range rendered {
+		if r.warning != "" {
+			warnings = append(warnings, fmt.Sprintf("%s (%s): %s", r.config.Path, r.config.Format, r.warning))
+		}
+	}
+	return warnings
+}
+
+// templateOutputError is returned by renderOutputs when a template output fails. A template is
+// operator-written code, so its error fails the whole run before any file is written (see
+// renderTemplate) rather than only skipping the output.
+type templateOutputError struct {
+	path string
+	err  error
+}
+
+func (e *templateOutputError) Error() string {
+	return fmt.Sprintf("template output %s: %v", e.path, e.err)
+}
+
+// renderOutputs renders every configured output in memory without touching the filesystem.
+// An output with an unknown format, a bad path or a render error is left out, so its live files
+// stay untouched; the other outputs and the nginx files still go ahead. The error lists the
+// outputs that were left out. A failing template output is the exception: renderOutputs then
+// returns a *templateOutputError and nothing else, and the caller must stop the run.
+func renderOutputs(outputs []OutputConfig, gen *generation) ([]renderedOutput, error) {
+	var rendered []renderedOutput
+	var failures []string
+	for _, out := range outputs {
+		files, err := renderOutput(out, gen)
+		if err != nil && out.Format == "template" {
+			return nil, &templateOutputError{path: out.Path, err: err}
+		}
+		var warning *outputWarning
+		if errors.As(err, &warning) {
+			logf("Warning for %s output %s: %v\n", out.Format, out.Path, warning)
+			rendered = append(rendered, renderedOutput{config: out, files: files, warning: warning.msg})
+			continue
+		}
+		if err != nil {
+			logf("Skipping %s output %s: %v\n", out.Format, out.Path, err)
+			failures = append(failures, fmt.Sprintf("%s (%s): %v", out.Path, out.Format, err))
+			continue
+		}
+		rendered = append(rendered, renderedOutput{config: out, files: files})
+	}
+	if len(failures) > 0 {
+		return rendered, fmt.Errorf("%d/%d output(s) failed to render: %s", len(failures), len(outputs), strings.Join(failures, "; "))
+	}
+	return rendered, nil
+}
+
+func renderOutput(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	render, ok := outputFormats[out.Format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q", out.Format)
+	}
+	if err := validateOutputPath(out.Path); err != nil {
+		return nil, err
+	}
+	if err := validateOutputName(outputName(out)); err != nil {
+		return nil, err
+	}
+	files, err := render(out, gen)
+	var warning *outputWarning
+	if err != nil && !errors.As(err, &warning) {
+		return nil, err
+	}
+	for _, f := range files {
+		if err := validateOutputPath(f.path); err != nil {
+			return nil, err
+		}
+	}
+	return files, err
+}
+
+// writeOutputs writes each rendered output atomically and then runs its post-write command.
+// Outputs are independent: a failure is logged and the remaining outputs are still attempted,
+// so one broken firewall hook does not keep the others on a stale list.
+func writeOutputs(rendered []renderedOutput) error {
+	var failures []string
+	for _, r := range rendered {
+		if err := writeRenderedOutput(r); err != nil {
+			logf("Failed to apply %s output %s: %v\n", r.config.Format, r.config.Path, err)
+			failures = append(failures, fmt.Sprintf("%s (%s): %v", r.config.Path, r.config.Format, err))
+			continue
+		}
+		logf("Wrote %s output %s.\n", r.config.Format, r.config.Path)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d/%d output(s) failed: %s", len(failures), len(rendered), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func writeRenderedOutput(r renderedOutput) error {
+	for _, f := range r.files {
+		if err := writeFileAtomic(f.path, f.content); err != nil {
+			return fmt.Errorf("write %s: %v", f.path, err)
+		}
+	}
+	if len(r.config.PostWriteCommand) > 0 {
+		if err := runPostWriteCommand(r.config.PostWriteCommand); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPostWriteCommand executes argv directly (never through a shell) with a hard timeout.
+// Combined output is included in the error so failures from nft/ipset are actionable.
+func runPostWriteCommand(argv []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postWriteTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, argv[0], argv[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("post-write command %q failed: %v: %s", strings.Join(argv, " "), err, strings.TrimSpace(string(output)))
+	}
+	logf("Post-write command %q succeeded.\n", strings.Join(argv, " "))
+	return nil
+}
+
+// outputName returns the configured table/set name, defaulting to "etr".
+func outputName(out OutputConfig) string {
+	if out.Name != "" {
+		return out.Name
+	}
+	return "etr"
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderOutputsRejectsBadConfig(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		output  OutputConfig
+		wantErr string
+	}{
+		{
+			name:    "unknown format",
+			output:  OutputConfig{Format: "iptables", Path: filepath.Join(dir, "x")},
+			wantErr: "unknown format",
+		},
+		{
+			name:    "path outside conf dir",
+			output:  OutputConfig{Format: "nftables", Path: "/etc/nftables.conf"},
+			wantErr: "outside allowed directory",
+		},
+		{
+			name:    "unsafe name",
+			output:  OutputConfig{Format: "ipset", Path: filepath.Join(dir, "x"), Name: "etr; flush"},
+			wantErr: "output name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := renderOutputs([]OutputConfig{tt.output}, &generation{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWriteOutputs(t *testing.T) {
+	dir := t.TempDir()
+	entries := []blocklistEntry{{addr: "203.0.113.5", label: "a"}}
+	marker := filepath.Join(dir, "applied")
+
+	rendered, err := renderOutputs([]OutputConfig{
+		{Format: "nftables", Path: filepath.Join(dir, "etr.nft"), PostWriteCommand: []string{"touch", marker}},
+		{Format: "ipset", Path: filepath.Join(dir, "etr.ipset")},
+	}, &generation{entries: entries})
+	if err != nil {
+		t.Fatalf("renderOutputs: %v", err)
+	}
+	if err := writeOutputs(rendered); err != nil {
+		t.Fatalf("writeOutputs: %v", err)
+	}
+
+	for _, name := range []string{"etr.nft", "etr.ipset", "applied"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to exist: %v", name, err)
+		}
+	}
+}
+
+func TestWriteOutputsContinuesAfterFailure(t *testing.T) {
+	dir := t.TempDir()
+	rendered, err := renderOutputs([]OutputConfig{
+		{Format: "nftables", Path: filepath.Join(dir, "etr.nft"), PostWriteCommand: []string{"false"}},
+		{Format: "ipset", Path: filepath.Join(dir, "etr.ipset")},
+	}, &generation{})
+	if err != nil {
+		t.Fatalf("renderOutputs: %v", err)
+	}
+
+	err = writeOutputs(rendered)
+	if err == nil || !strings.Contains(err.Error(), "1/2 output(s) failed") {
+		t.Errorf("expected one failed output, got %v", err)
+	}
+	if _, statErr := os.Stat(filepath.Join(dir, "etr.ipset")); statErr != nil {
+		t.Errorf("second output should still be written: %v", statErr)
+	}
+}
+
+func TestRenderOutputsSkipsOnlyTheFailedOutput(t *testing.T) {
+	dir := t.TempDir()
+	rendered, err := renderOutputs([]OutputConfig{
+		{Format: "iptables", Path: filepath.Join(dir, "x")},
+		{Format: "ipset", Path: filepath.Join(dir, "etr.ipset")},
+	}, &generation{})
+	if err == nil || !strings.Contains(err.Error(), "1/2 output(s) failed to render") {
+		t.Errorf("expected one failed output, got %v", err)
+	}
+	if len(rendered) != 1 || rendered[0].config.Format != "ipset" {
+		t.Errorf("the valid output should still be rendered, got %+v", rendered)
+	}
+}
+
+func TestRenderOutputsKeepsWarnedOutput(t *testing.T) {
+	dir := t.TempDir()
+	rendered, err := renderOutputs([]OutputConfig{
+		{Format: "apache", Mode: "rewritemap", Path: filepath.Join(dir, "etr.map"), SkipWideNetworks: true},
+	}, &generation{entries: []blocklistEntry{{addr: "10.0.0.0/8", label: "wide"}}})
+	if err != nil {
+		t.Fatalf("a warning is not a failure: %v", err)
+	}
+	warnings := outputWarnings(rendered)
+	if len(rendered) != 1 || len(warnings) != 1 || !strings.Contains(warnings[0], "skipped 1 network(s)") {
+		t.Errorf("expected the output with one warning, got %+v", rendered)
+	}
+}
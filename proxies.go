@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// caddyRangesPerLine keeps generated remote_ip/client_ip lines readable; Caddy merges
+// repeated matcher lines within one named matcher.
+const caddyRangesPerLine = 16
+
+// apacheRangesPerLine keeps generated "Require not ip" lines readable.
+const apacheRangesPerLine = 16
+
+// apacheMaxExpand caps how many addresses a network may hold to be expanded into RewriteMap keys.
+// RewriteMap txt lookups are exact-match, so networks must be listed address by address.
+const apacheMaxExpand = 256
+
+// traefikDenyPriority places the deny routers above every router using Traefik's default
+// priority (the rule length) so blocked clients never reach an application router.
+const traefikDenyPriority = 1 << 30
+
+// renderCaddy renders a Caddyfile fragment that answers blocked clients with 403.
+// Import it inside a site block (import /etc/caddy/etr/*.caddy). Mode "remote_ip" (default)
+// matches the connecting address; "client_ip" honours Caddy's trusted_proxies setting.
+func renderCaddy(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	matcher := out.Mode
+	if matcher == "" {
+		matcher = "remote_ip"
+	}
+	if matcher != "remote_ip" && matcher != "client_ip" {
+		return nil, fmt.Errorf("unknown caddy mode %q (want remote_ip or client_ip)", out.Mode)
+	}
+	name := outputName(out)
+	v4, v6 := collapseNetworks(gen.entries)
+	nets := append(v4, v6...)
+
+	var b bytes.Buffer
+	b.WriteString("# Generated by emerging-threats-rules; overwritten on every run.\n")
+	b.WriteString("# Import inside a site block, before reverse_proxy: import /etc/caddy/etr/*.caddy\n")
+	// An empty named matcher matches every request, so emit nothing to match against rather
+	// than a matcher with no ranges.
+	if len(nets) == 0 {
+		return []renderedFile{{path: out.Path, content: b.Bytes()}}, nil
+	}
+
+	fmt.Fprintf(&b, "\n@%s_blocked {\n", name)
+	for start := 0; start < len(nets); start += caddyRangesPerLine {
+		end := start + caddyRangesPerLine
+		if end > len(nets) {
+			end = len(nets)
+		}
+		fmt.Fprintf(&b, "\t%s %s\n", matcher, joinNetworks(nets[start:end], " "))
+	}
+	b.WriteString("}\n")
+	fmt.Fprintf(&b, "respond @%s_blocked 403\n", name)
+
+	return []renderedFile{{path: out.Path, content: b.Bytes()}}, nil
+}
+
+// renderTraefik renders a Traefik dynamic-configuration file for the file provider
+// (--providers.file.directory with --providers.file.watch=true, so no restart is needed).
+//
+// Mode "deny" (default) emits catch-all routers matching ClientIP of every blocked network,
+// for plain and TLS requests, whose middleware is an ipAllowList that admits no client:
+// Traefik answers them with 403 before any application router sees the request.
+// Mode "allowlist" instead emits an ipAllowList middleware built from the whitelist, to attach
+// to routers that should only be reachable from known-good addresses.
+func renderTraefik(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	name := outputName(out)
+
+	var b bytes.Buffer
+	b.WriteString("# Generated by emerging-threats-rules; overwritten on every run.\n")
+	b.WriteString("# Load with: --providers.file.directory=<dir> --providers.file.watch=true\n")
+
+	switch out.Mode {
+	case "", "deny":
+		v4, v6 := collapseNetworks(gen.entries)
+		nets := append(v4, v6...)
+
+		b.WriteString("http:\n")
+		if len(nets) > 0 {
+			clauses := make([]string, len(nets))
+			for i, n := range nets {
+				clauses[i] = "ClientIP(`" + n.String() + "`)"
+			}
+			rule := strings.Join(clauses, " || ")
+
+			b.WriteString("  routers:\n")
+			for _, router := range []string{name + "-deny", name + "-deny-tls"} {
+				fmt.Fprintf(&b, "    %s:\n", router)
+				fmt.Fprintf(&b, "      rule: %q\n", rule)
+				fmt.Fprintf(&b, "      priority: %d\n", traefikDenyPriority)
+				fmt.Fprintf(&b, "      middlewares:\n        - %s-deny\n", name)
+				b.WriteString("      service: noop@internal\n")
+				if strings.HasSuffix(router, "-tls") {
+					b.WriteString("      tls: {}\n")
+				}
+			}
+		}
+		b.WriteString("  middlewares:\n")
+		fmt.Fprintf(&b, "    %s-deny:\n", name)
+		b.WriteString("      # Admits no real client, so every request routed here gets 403.\n")
+		b.WriteString("      ipAllowList:\n        sourceRange:\n          - \"255.255.255.255/32\"\n")
+
+	case "allowlist":
+		var ranges []string
+		for entry := range gen.whitelist {
+			if n := parseNetwork(entry); n != nil {
+				ranges = append(ranges, n.String())
+			}
+		}
+		if len(ranges) == 0 {
+			return nil, fmt.Errorf("traefik allowlist mode needs at least one whitelist entry")
+		}
+		sort.Strings(ranges)
+
+		b.WriteString("http:\n  middlewares:\n")
+		fmt.Fprintf(&b, "    %s-allowlist:\n", name)
+		b.WriteString("      ipAllowList:\n        sourceRange:\n")
+		for _, r := range ranges {
+			fmt.Fprintf(&b, "          - %q\n", r)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown traefik mode %q (want deny or allowlist)", out.Mode)
+	}
+
+	return []renderedFile{{path: out.Path, content: b.Bytes()}}, nil
+}
+
+// renderApache renders blocklist configuration for Apache httpd 2.4.
+//
+// Mode "require" (default) emits a <RequireAll> block for mod_authz_host, to Include inside a
+// <Location> or <Directory>. Mode "rewritemap" emits a RewriteMap txt file mapping each blocked
+// address to its source label, so mod_rewrite can deny and log the label (convert it with
+// httxt2dbm for a dbm map). RewriteMap keys are exact addresses: networks are expanded up to
+// apacheMaxExpand addresses. A larger network fails the output, since the map would silently
+// not block it, unless out.SkipWideNetworks accepts leaving such networks out with a warning.
+func renderApache(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	var b bytes.Buffer
+	var warning error
+	b.WriteString("# Generated by emerging-threats-rules; overwritten on every run.\n")
+
+	switch out.Mode {
+	case "", "require":
+		v4, v6 := collapseNetworks(gen.entries)
+		nets := append(v4, v6...)
+
+		b.WriteString("<RequireAll>\n    Require all granted\n")
+		for start := 0; start < len(nets); start += apacheRangesPerLine {
+			end := start + apacheRangesPerLine
+			if end > len(nets) {
+				end = len(nets)
+			}
+			fmt.Fprintf(&b, "    Require not ip %s\n", joinNetworks(nets[start:end], " "))
+		}
+		b.WriteString("</RequireAll>\n")
+
+	case "rewritemap":
+		labels := make(map[string]string)
+		skipped := 0
+		for _, e := range gen.entries {
+			n := parseNetwork(e.addr)
+			if n == nil {
+				continue
+			}
+			ips := expandNetwork(n, apacheMaxExpand)
+			if ips == nil {
+				skipped++
+				continue
+			}
+			for _, ip := range ips {
+				key := ip.String()
+				// A more specific entry (e.g. a single IP inside a listed /24) keeps its own label.
+				if _, ok := labels[key]; ok && len(ips) > 1 {
+					continue
+				}
+				labels[key] = e.label
+			}
+		}
+		if skipped > 0 && !out.SkipWideNetworks {
+			return nil, fmt.Errorf("%d network(s) are larger than %d addresses and cannot be listed in a RewriteMap; use mode \"require\" to block them, or set skip_wide_networks",
+				skipped, apacheMaxExpand)
+		}
+		if skipped > 0 {
+			warning = &outputWarning{fmt.Sprintf("skipped %d network(s) larger than %d addresses; they are not blocked by this map", skipped, apacheMaxExpand)}
+		}
+
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%s %s\n", k, labels[k])
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown apache mode %q (want require or rewritemap)", out.Mode)
+	}
+
+	return []renderedFile{{path: out.Path, content: b.Bytes()}}, warning
+}
+
+// joinNetworks joins networks in CIDR notation with sep.
+func joinNetworks(nets []*net.IPNet, sep string) string {
+	s := make([]string, len(nets))
+	for i, n := range nets {
+		s[i] = n.String()
+	}
+	return strings.Join(s, sep)
+}
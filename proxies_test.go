@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRenderCaddy(t *testing.T) {
+	entries := []blocklistEntry{
+		{addr: "198.51.100.0/24", label: "a"},
+		{addr: "198.51.100.7", label: "b"},
+		{addr: "2001:db8::1", label: "a"},
+	}
+
+	tests := []struct {
+		mode    string
+		matcher string
+	}{
+		{mode: "", matcher: "remote_ip"},
+		{mode: "client_ip", matcher: "client_ip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.matcher, func(t *testing.T) {
+			files, err := renderCaddy(OutputConfig{Path: "etr.caddy", Mode: tt.mode}, &generation{entries: entries})
+			if err != nil {
+				t.Fatalf("renderCaddy: %v", err)
+			}
+			content := string(files[0].content)
+			want := "@etr_blocked {\n\t" + tt.matcher + " 198.51.100.0/24 2001:db8::1/128\n}\nrespond @etr_blocked 403\n"
+			if !strings.Contains(content, want) {
+				t.Errorf("expected %q in Caddy snippet:\n%s", want, content)
+			}
+		})
+	}
+}
+
+func TestRenderCaddyLongListIsWrapped(t *testing.T) {
+	var entries []blocklistEntry
+	for i := 0; i < caddyRangesPerLine+1; i++ {
+		entries = append(entries, blocklistEntry{addr: fmt.Sprintf("203.0.113.%d", i), label: "a"})
+	}
+
+	files, err := renderCaddy(OutputConfig{Path: "etr.caddy"}, &generation{entries: entries})
+	if err != nil {
+		t.Fatalf("renderCaddy: %v", err)
+	}
+	if n := strings.Count(string(files[0].content), "\tremote_ip "); n != 2 {
+		t.Errorf("expected 2 remote_ip lines, got %d", n)
+	}
+}
+
+func TestRenderCaddyEmptyHasNoMatcher(t *testing.T) {
+	files, err := renderCaddy(OutputConfig{Path: "etr.caddy"}, &generation{})
+	if err != nil {
+		t.Fatalf("renderCaddy: %v", err)
+	}
+	// An empty named matcher would match every request.
+	if strings.Contains(string(files[0].content), "@etr_blocked") {
+		t.Errorf("empty blocklist must not emit a matcher:\n%s", files[0].content)
+	}
+}
+
+func TestRenderCaddyRejectsUnknownMode(t *testing.T) {
+	if _, err := renderCaddy(OutputConfig{Path: "etr.caddy", Mode: "header"}, &generation{}); err == nil {
+		t.Errorf("expected error for unknown mode")
+	}
+}
+
+func TestRenderTraefikDeny(t *testing.T) {
+	entries := []blocklistEntry{
+		{addr: "198.51.100.0/24", label: "a"},
+		{addr: "2001:db8::1", label: "a"},
+	}
+
+	files, err := renderTraefik(OutputConfig{Path: "etr.yml"}, &generation{entries: entries})
+	if err != nil {
+		t.Fatalf("renderTraefik: %v", err)
+	}
+	content := string(files[0].content)
+
+	rule := "rule: \"ClientIP(`198.51.100.0/24`) || ClientIP(`2001:db8::1/128`)\"\n"
+	if n := strings.Count(content, rule); n != 2 {
+		t.Errorf("expected the deny rule on both routers, found %d:\n%s", n, content)
+	}
+	for _, want := range []string{
+		"    etr-deny:\n",
+		"    etr-deny-tls:\n",
+		"      tls: {}\n",
+		"      service: noop@internal\n",
+		"      middlewares:\n        - etr-deny\n",
+		"ipAllowList:\n        sourceRange:\n          - \"255.255.255.255/32\"\n",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected %q in Traefik config:\n%s", want, content)
+		}
+	}
+}
+
+func TestRenderTraefikDenyEmptyHasNoRouters(t *testing.T) {
+	files, err := renderTraefik(OutputConfig{Path: "etr.yml"}, &generation{})
+	if err != nil {
+		t.Fatalf("renderTraefik: %v", err)
+	}
+	if strings.Contains(string(files[0].content), "routers:") {
+		t.Errorf("empty blocklist must not emit routers with an empty rule:\n%s", files[0].content)
+	}
+}
+
+func TestRenderTraefikAllowlist(t *testing.T) {
+	gen := &generation{whitelist: map[string]string{
+		"203.0.113.0/28": "local_whitelist",
+		"192.0.2.10":     "https://example.com/allow.txt",
+	}}
+
+	files, err := renderTraefik(OutputConfig{Path: "etr.yml", Mode: "allowlist", Name: "office"}, gen)
+	if err != nil {
+		t.Fatalf("renderTraefik: %v", err)
+	}
+	want := "    office-allowlist:\n      ipAllowList:\n        sourceRange:\n          - \"192.0.2.10/32\"\n          - \"203.0.113.0/28\"\n"
+	if !strings.Contains(string(files[0].content), want) {
+		t.Errorf("expected %q in Traefik config:\n%s", want, files[0].content)
+	}
+
+	if _, err := renderTraefik(OutputConfig{Path: "etr.yml", Mode: "allowlist"}, &generation{}); err == nil {
+		t.Errorf("allowlist mode with an empty whitelist should fail")
+	}
+}
+
+func TestRenderApacheRequire(t *testing.T) {
+	entries := []blocklistEntry{
+		{addr: "198.51.100.0/24", label: "a"},
+		{addr: "198.51.100.7", label: "b"},
+		{addr: "2001:db8::/32", label: "a"},
+	}
+
+	files, err := renderApache(OutputConfig{Path: "etr-apache.conf"}, &generation{entries: entries})
+	if err != nil {
+		t.Fatalf("renderApache: %v", err)
+	}
+	want := "<RequireAll>\n    Require all granted\n    Require not ip 198.51.100.0/24 2001:db8::/32\n</RequireAll>\n"
+	if !strings.HasSuffix(string(files[0].content), want) {
+		t.Errorf("unexpected Require block:\n%s", files[0].content)
+	}
+}
+
+func TestRenderApacheRewriteMap(t *testing.T) {
+	entries := []blocklistEntry{
+		{addr: "198.51.100.0/30", label: "ipsum-8"},
+		{addr: "198.51.100.2", label: "compromised-ips"},
+		{addr: "203.0.113.0/16", label: "too-big"},
+		{addr: "2001:db8::1", label: "local"},
+	}
+
+	_, err := renderApache(OutputConfig{Path: "etr-apache.map", Mode: "rewritemap"}, &generation{entries: entries})
+	if err == nil || !strings.Contains(err.Error(), "1 network(s) are larger than 256 addresses") {
+		t.Fatalf("a network too wide for the map must fail the output, got %v", err)
+	}
+
+	files, err := renderApache(OutputConfig{Path: "etr-apache.map", Mode: "rewritemap", SkipWideNetworks: true}, &generation{entries: entries})
+	var warning *outputWarning
+	if !errors.As(err, &warning) || !strings.Contains(warning.msg, "skipped 1 network(s)") {
+		t.Fatalf("expected a warning for the skipped network, got %v", err)
+	}
+	content := string(files[0].content)
+
+	want := "198.51.100.0 ipsum-8\n198.51.100.1 ipsum-8\n198.51.100.2 compromised-ips\n198.51.100.3 ipsum-8\n2001:db8::1 local\n"
+	if !strings.HasSuffix(content, want) {
+		t.Errorf("unexpected RewriteMap:\n%s", content)
+	}
+	if strings.Contains(content, "too-big") {
+		t.Errorf("networks larger than %d addresses must not be expanded:\n%s", apacheMaxExpand, content)
+	}
+}
+
+func TestRenderApacheRejectsUnknownMode(t *testing.T) {
+	if _, err := renderApache(OutputConfig{Path: "x", Mode: "deny"}, &generation{}); err == nil {
+		t.Errorf("expected error for unknown mode")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/client"
+)
+
+// What to do with a target container that is not running, selected by nginx_stopped_containers.
+const (
+	stoppedStart = "start" // reload it anyway; a restart starts it (default)
+	stoppedSkip  = "skip"  // leave it stopped; it loads the new files whenever it is started
+	stoppedFail  = "fail"  // leave it stopped and report it as a failure
+)
+
+// Per-container outcomes of a rollout.
+const (
+	resultReloaded     = "reloaded"
+	resultSkipped      = "skipped"
+	resultNotFound     = "not found"
+	resultNotRunning   = "not running"
+	resultTimeout      = "timeout"
+	resultAPIError     = "API error"
+	resultInvalidName  = "invalid name"
+	resultUnhealthy    = "unhealthy"
+	resultNotAttempted = "not attempted"
+)
+
+// containerResult is the outcome of applying the new blocklist to one container.
+type containerResult struct {
+	name   string
+	status string
+	err    error
+}
+
+// rolloutResults holds one result per target container, in rollout order.
+type rolloutResults []containerResult
+
+// failures counts the containers that did not pick up the new blocklist. Skipped containers
+// are not failures: the policy asked for them to be left alone.
+func (r rolloutResults) failures() int {
+	n := 0
+	for _, res := range r {
+		if res.status != resultReloaded && res.status != resultSkipped {
+			n++
+		}
+	}
+	return n
+}
+
+// summary renders one line per container for logs and notifications.
+func (r rolloutResults) summary() string {
+	var b strings.Builder
+	for _, res := range r {
+		fmt.Fprintf(&b, "  %s: %s", res.name, res.status)
+		if res.err != nil {
+			fmt.Fprintf(&b, " (%v)", res.err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// nginxRollout is how a new blocklist is applied to the nginx containers.
+type nginxRollout struct {
+	// defaultStrategy and overrides pick each container's reload strategy; see reloadNginxContainer.
+	defaultStrategy string
+	overrides       map[string]string
+	gate            healthGate
+	stopped         string
+}
+
+// validateStoppedPolicy checks nginx_stopped_containers.
+func validateStoppedPolicy(policy string) error {
+	switch policy {
+	case "", stoppedStart, stoppedSkip, stoppedFail:
+		return nil
+	}
+	return fmt.Errorf("unknown nginx_stopped_containers %q (want start, skip or fail)", policy)
+}
+
+// apply reloads each container in turn and returns every container's result. A container that
+// fails is recorded and the rollout moves on, so one missing container does not keep the
+// others on the old list. The one exception is a replica that is reloaded but does not pass the
+// health gate: the rollout stops there, so replicas behind a load balancer are never all down at
+// once, and the remaining containers are reported as not attempted.
+func (r nginxRollout) apply(cli containerAPI, containerNames []string) rolloutResults {
+	results := make(rolloutResults, 0, len(containerNames))
+	for i, containerName := range containerNames {
+		res := r.applyOne(cli, containerName)
+		results = append(results, res)
+		if res.status == resultUnhealthy {
+			for _, rest := range containerNames[i+1:] {
+				results = append(results, containerResult{name: rest, status: resultNotAttempted})
+			}
+			break
+		}
+	}
+	return results
+}
+
+func (r nginxRollout) applyOne(cli containerAPI, containerName string) containerResult {
+	if err := validateContainerName(containerName); err != nil {
+		return containerResult{name: containerName, status: resultInvalidName, err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerOpTimeout)
+	inspected, err := cli.ContainerInspect(ctx, containerName, client.ContainerInspectOptions{})
+	cancel()
+	if err != nil {
+		return containerResult{name: containerName, status: classifyDockerError(err), err: err}
+	}
+	if state := inspected.Container.State; state == nil || !state.Running {
+		switch r.stopped {
+		case stoppedSkip:
+			logf("Container %s is not running, skipping.\n", containerName)
+			return containerResult{name: containerName, status: resultSkipped}
+		case stoppedFail:
+			return containerResult{name: containerName, status: resultNotRunning}
+		}
+	}
+
+	strategy := r.overrides[containerName]
+	if strategy == "" {
+		strategy = r.defaultStrategy
+	}
+	reloadedAt := time.Now()
+	if err := reloadNginxContainer(cli, containerName, strategy); err != nil {
+		return containerResult{name: containerName, status: classifyDockerError(err), err: err}
+	}
+	if err := r.gate.wait(cli, containerName, reloadedAt); err != nil {
+		return containerResult{name: containerName, status: resultUnhealthy, err: err}
+	}
+	logf("Container %s is healthy.\n", containerName)
+	return containerResult{name: containerName, status: resultReloaded}
+}
+
+// classifyDockerError maps a Docker API error to a result status.
+func classifyDockerError(err error) string {
+	switch {
+	case cerrdefs.IsNotFound(err):
+		return resultNotFound
+	case errors.Is(err, context.DeadlineExceeded) || cerrdefs.IsDeadlineExceeded(err):
+		return resultTimeout
+	case cerrdefs.IsConflict(err):
+		// The daemon answers 409 Conflict when signalling or exec-ing into a stopped container.
+		return resultNotRunning
+	default:
+		return resultAPIError
+	}
+}
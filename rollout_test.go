@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/api/types/container"
+)
+
+func TestNginxRolloutAttemptsEveryContainer(t *testing.T) {
+	stopped := []container.State{{Status: container.StateExited}}
+	fake := &fakeDocker{
+		errors: map[string]error{
+			"inspect_gone": fmt.Errorf("No such container: gone: %w", cerrdefs.ErrNotFound),
+			"restart_slow": fmt.Errorf("restarting: %w", context.DeadlineExceeded),
+			"restart_busy": fmt.Errorf("daemon unavailable"),
+		},
+		states: map[string][]container.State{"stopped": stopped},
+	}
+	names := []string{"gone", "stopped", "slow", "busy", "ok", "bad name"}
+
+	results := nginxRollout{stopped: stoppedFail}.apply(fake, names)
+
+	want := map[string]string{
+		"gone":     resultNotFound,
+		"stopped":  resultNotRunning,
+		"slow":     resultTimeout,
+		"busy":     resultAPIError,
+		"ok":       resultReloaded,
+		"bad name": resultInvalidName,
+	}
+	if len(results) != len(names) {
+		t.Fatalf("got %d results, want one per container:\n%s", len(results), results.summary())
+	}
+	for _, res := range results {
+		if res.status != want[res.name] {
+			t.Errorf("%s: status %q, want %q", res.name, res.status, want[res.name])
+		}
+	}
+	if results.failures() != 5 {
+		t.Errorf("failures = %d, want 5", results.failures())
+	}
+	if got := fmt.Sprint(fake.restarts); got != "[slow busy ok]" {
+		t.Errorf("restarts = %s, want the stopped container left alone", got)
+	}
+	if summary := results.summary(); !strings.Contains(summary, "  slow: timeout (failed to restart container slow: restarting: context deadline exceeded)\n") {
+		t.Errorf("summary should list each container with its error:\n%s", summary)
+	}
+}
+
+func TestNginxRolloutStoppedPolicy(t *testing.T) {
+	states := map[string][]container.State{"nginx1": {{Status: container.StateExited}}}
+
+	fake := &fakeDocker{states: states}
+	results := nginxRollout{stopped: stoppedSkip}.apply(fake, []string{"nginx1"})
+	if results[0].status != resultSkipped || results.failures() != 0 || len(fake.restarts) != 0 {
+		t.Errorf("skip: want nginx1 skipped without a failure or restart, got %+v, restarts %v", results, fake.restarts)
+	}
+
+	// The default starts a stopped container through the restart; here it never comes up.
+	shortenHealthPolling(t)
+	fake = &fakeDocker{states: states}
+	results = nginxRollout{gate: healthGate{timeout: 10 * time.Millisecond}}.apply(fake, []string{"nginx1"})
+	if len(fake.restarts) != 1 || results[0].status != resultUnhealthy {
+		t.Errorf("start: want nginx1 restarted and reported unhealthy, got %+v, restarts %v", results, fake.restarts)
+	}
+
+	if err := validateStoppedPolicy("ignore"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
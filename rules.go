@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Rule source formats for SourceOptions.Format.
+const (
+	sourceFormatPlain = "plain"
+	sourceFormatRules = "rules"
+)
+
+// Rule header sides for SourceOptions.RuleSide: which address field of a rule holds the
+// addresses to block.
+const (
+	ruleSideSrc  = "src"
+	ruleSideDst  = "dst"
+	ruleSideBoth = "both"
+)
+
+var (
+	ruleMsgRegex       = regexp.MustCompile(`msg\s*:\s*"((?:[^"\\]|\\.)*)"`)
+	ruleClasstypeRegex = regexp.MustCompile(`classtype\s*:\s*([^;]+);`)
+	ruleGroupSuffix    = regexp.MustCompile(`\s+group\s+\d+$`)
+)
+
+// ruleLabelNoise lists msg words that add length but no meaning to a label.
+var ruleLabelNoise = map[string]bool{
+	"traffic": true, "inbound": true, "outbound": true, "listed": true,
+	"known": true, "or": true, "and": true, "source": true,
+}
+
+// ruleLabelMaxWords caps how many msg words make it into a label.
+const ruleLabelMaxWords = 4
+
+// isRulesSource reports whether a blocklist source should be parsed as Suricata/Snort rules:
+// either explicitly via source_options ("format": "rules"), or because its path ends in ".rules".
+func isRulesSource(source string, opts SourceOptions) bool {
+	switch opts.Format {
+	case sourceFormatRules:
+		return true
+	case sourceFormatPlain:
+		return false
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	return path.Ext(u.Path) == ".rules"
+}
+
+// parseRules extracts blocked addresses from Suricata/Snort rule files such as Emerging Threats'
+// emerging-drop.rules and compromised.rules, where the IPs sit in the rule header's address
+// groups (e.g. "alert ip [1.2.3.4,5.6.7.0/24] any -> $HOME_NET any (...)").
+//
+// Only the side named by side is read: the source field by default, where reputation rules put
+// the hostile hosts. Reading the destination too would block whatever a monitoring rule watches,
+// e.g. the resolver in "alert udp $HOME_NET any -> 8.8.8.8 53". Feeds of outbound rules (C2
+// servers) list their hosts as the destination and are read with side "dst".
+// Within a field, negated entries are carved out of the positive ones; $VARIABLES and "any"
+// cannot be resolved and are skipped. Commented-out (disabled) rules are ignored.
+// The result maps each address to a label built from the rule's msg (or classtype).
+func parseRules(contents, side string) map[string]string {
+	addresses := make(map[string]string)
+
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		open := strings.Index(line, "(")
+		if open < 0 {
+			continue
+		}
+		fields := splitRuleHeader(line[:open])
+		// action proto src_addr src_port direction dst_addr dst_port
+		if len(fields) < 7 {
+			continue
+		}
+
+		label := ruleLabel(line[open:])
+		var sides []string
+		switch side {
+		case ruleSideDst:
+			sides = []string{fields[5]}
+		case ruleSideBoth:
+			sides = []string{fields[2], fields[5]}
+		default:
+			sides = []string{fields[2]}
+		}
+		for _, field := range sides {
+			for _, address := range ruleAddresses(field) {
+				addresses[address] = label
+			}
+		}
+	}
+
+	return addresses
+}
+
+// splitRuleHeader splits a rule header on whitespace outside of [...] groups.
+func splitRuleHeader(header string) []string {
+	var fields []string
+	var current strings.Builder
+	depth := 0
+	for _, r := range header {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+		case (r == ' ' || r == '\t') && depth == 0:
+			if current.Len() > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if current.Len() > 0 {
+		fields = append(fields, current.String())
+	}
+	return fields
+}
+
+// ruleAddresses resolves one address field to the concrete networks it blocks.
+func ruleAddresses(field string) []string {
+	var include, exclude []*net.IPNet
+	collectRuleAddresses(field, false, &include, &exclude)
+
+	var result []string
+	for _, base := range include {
+		remaining := []*net.IPNet{base}
+		for _, ex := range exclude {
+			var next []*net.IPNet
+			for _, subnet := range remaining {
+				next = append(next, subtractCIDR(subnet, ex)...)
+			}
+			remaining = next
+		}
+		for _, n := range remaining {
+			result = append(result, networkString(n))
+		}
+	}
+	return result
+}
+
+// collectRuleAddresses walks a (possibly nested, possibly negated) address group, sorting each
+// literal IP/CIDR into include or exclude according to the negation in effect.
+func collectRuleAddresses(field string, negated bool, include, exclude *[]*net.IPNet) {
+	field = strings.TrimSpace(field)
+	for strings.HasPrefix(field, "!") {
+		negated = !negated
+		field = strings.TrimSpace(field[1:])
+	}
+
+	if strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]") {
+		for _, element := range splitRuleGroup(field[1 : len(field)-1]) {
+			collectRuleAddresses(element, negated, include, exclude)
+		}
+		return
+	}
+
+	if field == "" || field == "any" || strings.HasPrefix(field, "$") {
+		return
+	}
+	n := parseNetwork(field)
+	if n == nil {
+		return
+	}
+	if negated {
+		*exclude = append(*exclude, n)
+	} else {
+		*include = append(*include, n)
+	}
+}
+
+// splitRuleGroup splits the inside of an address group on commas outside nested groups.
+func splitRuleGroup(group string) []string {
+	var elements []string
+	depth, start := 0, 0
+	for i, r := range group {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				elements = append(elements, group[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(elements, group[start:])
+}
+
+// networkString formats single-address networks as a bare IP, matching parseIPAddresses.
+func networkString(n *net.IPNet) string {
+	if ones, bits := n.Mask.Size(); ones == bits {
+		return n.IP.String()
+	}
+	return n.String()
+}
+
+// ruleLabel builds an nginx-safe label from a rule's options: the msg with the "group N"
+// suffix and filler words dropped, e.g. "ET DROP Spamhaus DROP Listed Traffic Inbound group 1"
+// → "et-drop-spamhaus". Falls back to the classtype, then to "et-rule".
+func ruleLabel(options string) string {
+	if m := ruleMsgRegex.FindStringSubmatch(options); m != nil {
+		msg := ruleGroupSuffix.ReplaceAllString(strings.TrimSpace(m[1]), "")
+		var words []string
+		seen := make(map[string]bool)
+		for _, word := range strings.FieldsFunc(strings.ToLower(msg), isNotLabelChar) {
+			if ruleLabelNoise[word] || seen[word] {
+				continue
+			}
+			seen[word] = true
+			words = append(words, word)
+			if len(words) == ruleLabelMaxWords {
+				break
+			}
+		}
+		if len(words) > 0 {
+			return strings.Join(words, "-")
+		}
+	}
+	if m := ruleClasstypeRegex.FindStringSubmatch(options); m != nil {
+		if words := strings.FieldsFunc(strings.ToLower(m[1]), isNotLabelChar); len(words) > 0 {
+			return strings.Join(words, "-")
+		}
+	}
+	return "et-rule"
+}
+
+func isNotLabelChar(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	content := `# Emerging Threats
+#
+#alert ip [192.0.2.99] any -> $HOME_NET any (msg:"ET DROP disabled rule"; sid:1;)
+alert ip [198.51.100.1,198.51.100.0/30,203.0.113.0/24] any -> $HOME_NET any (msg:"ET DROP Spamhaus DROP Listed Traffic Inbound group 1"; classtype:misc-attack; sid:2400000; rev:1;)
+alert ip $HOME_NET any -> [192.0.2.0/29,!192.0.2.4] any (msg:"ET COMPROMISED Known Compromised or Hostile Host Traffic group 2"; classtype:misc-attack; sid:2500000; rev:1;)
+alert ip [2001:db8::1,$EXTERNAL_NET,any] any -> any any (classtype:misc-attack; sid:2500001; rev:1;)
+drop ip ![192.0.2.200] any -> $HOME_NET any (msg:"ET negated only"; sid:2500002; rev:1;)
+`
+
+	src := map[string]string{
+		"198.51.100.1":    "et-drop-spamhaus",
+		"198.51.100.0/30": "et-drop-spamhaus",
+		"203.0.113.0/24":  "et-drop-spamhaus",
+		"2001:db8::1":     "misc-attack",
+	}
+	dst := map[string]string{
+		// 192.0.2.0/29 minus 192.0.2.4
+		"192.0.2.0/30": "et-compromised-hostile-host",
+		"192.0.2.5":    "et-compromised-hostile-host",
+		"192.0.2.6/31": "et-compromised-hostile-host",
+	}
+	both := make(map[string]string)
+	for _, m := range []map[string]string{src, dst} {
+		for address, label := range m {
+			both[address] = label
+		}
+	}
+
+	tests := []struct {
+		side string
+		want map[string]string
+	}{
+		{"", src},
+		{ruleSideDst, dst},
+		{ruleSideBoth, both},
+	}
+	for _, tt := range tests {
+		got := parseRules(content, tt.side)
+		for address, label := range tt.want {
+			if got[address] != label {
+				t.Errorf("side %q: %s: label %q, want %q", tt.side, address, got[address], label)
+			}
+		}
+		if len(got) != len(tt.want) {
+			var keys []string
+			for k := range got {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			t.Errorf("side %q: expected %d addresses, got %d: %v", tt.side, len(tt.want), len(got), keys)
+		}
+	}
+}
+
+func TestParseRulesSkipsMonitoredDestination(t *testing.T) {
+	// A rule watching traffic to a resolver must not block the resolver.
+	content := `alert udp $HOME_NET any -> 8.8.8.8 53 (msg:"ET DNS Query to Public Resolver"; sid:1;)`
+	if got := parseRules(content, ""); len(got) != 0 {
+		t.Errorf("expected no addresses, got %v", got)
+	}
+}
+
+func TestRuleAddressesNestedNegation(t *testing.T) {
+	got := ruleAddresses("[10.0.0.0/30,![10.0.0.1,![10.0.0.9]],$HOME_NET]")
+	sort.Strings(got)
+	// 10.0.0.1 is excluded; the doubly negated 10.0.0.9 becomes a plain include.
+	if strings.Join(got, ",") != "10.0.0.0,10.0.0.2/31,10.0.0.9" {
+		t.Errorf("unexpected addresses: %v", got)
+	}
+}
+
+func TestRuleLabel(t *testing.T) {
+	tests := []struct {
+		options string
+		want    string
+	}{
+		{`(msg:"ET DROP Dshield Block Listed Source group 1"; sid:1;)`, "et-drop-dshield-block"},
+		{`(msg:"ET TOR Known Tor Exit Node Traffic group 42"; sid:1;)`, "et-tor-exit-node"},
+		{`(msg:"ET CINS Active Threat Intelligence Poor Reputation IP group 3"; sid:1;)`, "et-cins-active-threat"},
+		{`(classtype:trojan-activity; sid:1;)`, "trojan-activity"},
+		{`(sid:1;)`, "et-rule"},
+	}
+	for _, tt := range tests {
+		if got := ruleLabel(tt.options); got != tt.want {
+			t.Errorf("ruleLabel(%s) = %q, want %q", tt.options, got, tt.want)
+		}
+	}
+}
+
+func TestIsRulesSource(t *testing.T) {
+	tests := []struct {
+		source string
+		opts   SourceOptions
+		want   bool
+	}{
+		{"https://rules.emergingthreats.net/blockrules/emerging-drop.rules", SourceOptions{}, true},
+		{"https://rules.emergingthreats.net/fwrules/emerging-Block-IPs.txt", SourceOptions{}, false},
+		{"https://example.com/feed", SourceOptions{Format: "rules"}, true},
+		{"https://example.com/feed.rules", SourceOptions{Format: "plain"}, false},
+	}
+	for _, tt := range tests {
+		if got := isRulesSource(tt.source, tt.opts); got != tt.want {
+			t.Errorf("isRulesSource(%s, %+v) = %v, want %v", tt.source, tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestLabelFromSourceFragment(t *testing.T) {
+	source := "https://rules.emergingthreats.net/blockrules/emerging-drop.rules#et-drop-spamhaus"
+	if got := labelFromSource(source); got != "et-drop-spamhaus" {
+		t.Errorf("labelFromSource = %q, want fragment label", got)
+	}
+	if got := sourceKey(source); got != "https://rules.emergingthreats.net/blockrules/emerging-drop.rules" {
+		t.Errorf("sourceKey = %q", got)
+	}
+}
@@ -20,6 +20,8 @@ const (
 	maxResponseSize = 50 * 1024 * 1024
 	// dockerOpTimeout caps each individual Docker stop/start call.
 	dockerOpTimeout = 60 * time.Second
+	// postWriteTimeout caps each output's post-write command (e.g. nft -f, ipset restore).
+	postWriteTimeout = 60 * time.Second
 )
 
 // httpClient is a shared client with a hard timeout; the zero-value http.Client has no timeout.
@@ -29,6 +31,10 @@ var httpClient = &http.Client{Timeout: httpTimeout}
 // alphanumeric, hyphens, underscores, and periods — no path separators or shell metacharacters.
 var validContainerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
 
+// validOutputName matches table/set names for firewall outputs. ipset caps names at 31 characters,
+// so 24 leaves room for the "-v4-tmp" style suffixes added by the renderers.
+var validOutputName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]{0,23}$`)
+
 // privateIPNets holds RFC-1918, loopback, link-local, and other reserved ranges used to
 // block SSRF attacks that resolve to internal addresses.
 var privateIPNets []*net.IPNet
@@ -106,11 +112,35 @@ func validateConfFilePath(filePath string) error {
 	if filePath == "" {
 		return fmt.Errorf("nginx_conf_file_path is empty")
 	}
+	if !isWithinConfDir(filePath) {
+		return fmt.Errorf("nginx_conf_file_path %q is outside allowed directory %q", filePath, allowedConfDir)
+	}
+	return nil
+}
+
+// validateOutputPath applies the same directory restriction to the path of an additional output.
+func validateOutputPath(filePath string) error {
+	if filePath == "" {
+		return fmt.Errorf("output path is empty")
+	}
+	if !isWithinConfDir(filePath) {
+		return fmt.Errorf("output path %q is outside allowed directory %q", filePath, allowedConfDir)
+	}
+	return nil
+}
+
+// isWithinConfDir reports whether filePath is allowedConfDir or lies beneath it.
+func isWithinConfDir(filePath string) bool {
 	clean := filepath.Clean(filePath)
 	allowedClean := filepath.Clean(allowedConfDir)
 	prefix := allowedClean + string(filepath.Separator)
-	if clean != allowedClean && !strings.HasPrefix(clean, prefix) {
-		return fmt.Errorf("nginx_conf_file_path %q is outside allowed directory %q", filePath, allowedConfDir)
+	return clean == allowedClean || strings.HasPrefix(clean, prefix)
+}
+
+// validateOutputName rejects table/set names that are not safe to embed in nft or ipset scripts.
+func validateOutputName(name string) error {
+	if !validOutputName.MatchString(name) {
+		return fmt.Errorf("output name %q is invalid (letter first, then up to 23 of [a-zA-Z0-9_-])", name)
 	}
 	return nil
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Source modes set via source_options.
+const (
+	sourceModeEnforce = "enforce"
+	sourceModeShadow  = "shadow"
+)
+
+// shadowStateFileName tracks when each shadow source started shadowing, when it last listed a
+// whitelisted address and when it was promoted. It lives next to blocklist.conf like the
+// first-seen state.
+const shadowStateFileName = ".etr-shadow.json"
+
+// dateLayout is the YYYY-MM-DD format used for all persisted dates.
+const dateLayout = "2006-01-02"
+
+// shadowState is the persisted evaluation state of one shadow source.
+type shadowState struct {
+	Since     string `json:"since"`
+	LastDirty string `json:"last_dirty,omitempty"`
+	Promoted  string `json:"promoted,omitempty"`
+}
+
+// shadowStatePath returns the location of the shadow state for a given nginx conf path.
+func shadowStatePath(confFilePath string) string {
+	return filepath.Join(filepath.Dir(confFilePath), shadowStateFileName)
+}
+
+// loadShadowState reads the source → shadowState map. A missing file is not an error.
+func loadShadowState(filePath string) (map[string]shadowState, error) {
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]shadowState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]shadowState)
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filePath, err)
+	}
+	return states, nil
+}
+
+// saveShadowState writes the shadow state atomically.
+func saveShadowState(filePath string, states map[string]shadowState) error {
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, data)
+}
+
+// shadowConfigured reports whether any source is configured in shadow mode, promoted or not.
+// The $etr_shadow_source geo block is emitted whenever this is true so nginx configs that log it
+// keep loading after every shadow source has been promoted.
+func shadowConfigured(sources map[string]SourceOptions) bool {
+	for _, opts := range sources {
+		if opts.Mode == sourceModeShadow {
+			return true
+		}
+	}
+	return false
+}
+
+// applyShadowMode splits the merged blocklist into enforced and shadow parts and advances each
+// shadow source's state for today.
+//
+// A day is "dirty" for a shadow source when it lists an address overlapping the whitelist — the
+// one false-positive signal the generator can see. A source is promoted (and from then on
+// enforced) once today reaches its promote_on date, or once it has gone
+// promote_after_clean_days days without a dirty day. Promotion is recorded and never undone;
+// remove mode "shadow" from the source to forget it.
+func applyShadowMode(
+	blocklist map[string][]string,
+	sources map[string]SourceOptions,
+	whitelist map[string]string,
+	previous map[string]shadowState,
+	today string,
+) (enforced, shadow map[string][]string, states map[string]shadowState) {
+	var whitelistNets []*net.IPNet
+	for entry := range whitelist {
+		if n := parseNetwork(entry); n != nil {
+			whitelistNets = append(whitelistNets, n)
+		}
+	}
+
+	// Only addresses listed by a shadow source need the (comparatively costly) overlap check.
+	dirty := make(map[string]bool)
+	for address, srcs := range blocklist {
+		var candidates []string
+		for _, src := range srcs {
+			if key := sourceKey(src); sources[key].Mode == sourceModeShadow && !dirty[key] {
+				candidates = append(candidates, key)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		if n := parseNetwork(address); n != nil && overlapsAny(n, whitelistNets) {
+			for _, key := range candidates {
+				dirty[key] = true
+			}
+		}
+	}
+
+	states = make(map[string]shadowState)
+	shadowed := make(map[string]bool)
+	for source, opts := range sources {
+		if opts.Mode != sourceModeShadow {
+			continue
+		}
+		state, ok := previous[source]
+		if !ok {
+			state = shadowState{Since: today}
+			logf("Source %s is in shadow mode: matches are logged in $etr_shadow_source, not blocked.\n", source)
+		}
+		if dirty[source] {
+			state.LastDirty = today
+		}
+		if state.Promoted == "" {
+			if reason := promotionReason(opts, state, today); reason != "" {
+				state.Promoted = today
+				logf("Promoting shadow source %s to enforcing: %s.\n", source, reason)
+			}
+		}
+		if state.Promoted == "" {
+			shadowed[source] = true
+		}
+		states[source] = state
+	}
+
+	enforced = make(map[string][]string, len(blocklist))
+	shadow = make(map[string][]string)
+	for address, srcs := range blocklist {
+		for _, src := range srcs {
+			if shadowed[sourceKey(src)] {
+				shadow[address] = append(shadow[address], src)
+			} else {
+				enforced[address] = append(enforced[address], src)
+			}
+		}
+	}
+	return enforced, shadow, states
+}
+
+// promotionReason returns why a shadow source should be promoted today, or "" if it should not.
+func promotionReason(opts SourceOptions, state shadowState, today string) string {
+	if opts.PromoteOn != "" && today >= opts.PromoteOn {
+		return "promote_on date " + opts.PromoteOn + " reached"
+	}
+	if opts.PromoteAfterCleanDays > 0 {
+		start := state.Since
+		if state.LastDirty > start {
+			start = state.LastDirty
+		}
+		if days := daysBetween(start, today); days >= opts.PromoteAfterCleanDays {
+			return fmt.Sprintf("%d clean day(s)", days)
+		}
+	}
+	return ""
+}
+
+// daysBetween returns the whole days from one YYYY-MM-DD date to another (0 if unparsable).
+func daysBetween(from, to string) int {
+	start, err := time.Parse(dateLayout, from)
+	if err != nil {
+		return 0
+	}
+	end, err := time.Parse(dateLayout, to)
+	if err != nil {
+		return 0
+	}
+	return int(end.Sub(start).Hours() / 24)
+}
+
+// overlapsAny reports whether n overlaps any of nets. CIDRs are aligned, so two networks overlap
+// exactly when one contains the other's network address.
+func overlapsAny(n *net.IPNet, nets []*net.IPNet) bool {
+	for _, other := range nets {
+		if n.Contains(other.IP) || other.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderShadowGeo renders the shadow sources' carved matches as "geo $etr_shadow_source", in the
+// same layout as the blocklist. nginx can log the variable without enforcing it.
+func renderShadowGeo(entries []blocklistEntry) []byte {
+	var b bytes.Buffer
+	b.WriteString("geo $etr_shadow_source {\n    default        \"\";\n\n")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "    %s    %s;\n", e.addr, e.label)
+	}
+	b.WriteString("\n}")
+	return b.Bytes()
+}
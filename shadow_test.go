@@ -0,0 +1,145 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testShadowURL = "https://example.com/lists/new-feed.txt"
+
+func TestApplyShadowModeSplitsSources(t *testing.T) {
+	blocklist := map[string][]string{
+		"192.0.2.1":       {testIpsumURL, testShadowURL},
+		"198.51.100.0/24": {testShadowURL},
+		"203.0.113.9":     {testIpsumURL},
+	}
+	sources := map[string]SourceOptions{testShadowURL: {Mode: sourceModeShadow}}
+
+	enforced, shadow, states := applyShadowMode(blocklist, sources, nil, nil, "2026-03-01")
+
+	wantEnforced := map[string][]string{
+		"192.0.2.1":   {testIpsumURL},
+		"203.0.113.9": {testIpsumURL},
+	}
+	wantShadow := map[string][]string{
+		"192.0.2.1":       {testShadowURL},
+		"198.51.100.0/24": {testShadowURL},
+	}
+	if !reflect.DeepEqual(enforced, wantEnforced) {
+		t.Errorf("enforced = %v, want %v", enforced, wantEnforced)
+	}
+	if !reflect.DeepEqual(shadow, wantShadow) {
+		t.Errorf("shadow = %v, want %v", shadow, wantShadow)
+	}
+	if want := (shadowState{Since: "2026-03-01"}); states[testShadowURL] != want {
+		t.Errorf("state = %+v, want %+v", states[testShadowURL], want)
+	}
+}
+
+func TestApplyShadowModePromotion(t *testing.T) {
+	blocklist := map[string][]string{"198.51.100.0/24": {testShadowURL}}
+	whitelist := map[string]string{"198.51.100.5": "local_whitelist"}
+
+	tests := []struct {
+		name         string
+		opts         SourceOptions
+		previous     shadowState
+		whitelist    map[string]string
+		wantPromoted bool
+		wantDirty    string
+	}{
+		{
+			name:     "before promote_on",
+			opts:     SourceOptions{Mode: sourceModeShadow, PromoteOn: "2026-03-10"},
+			previous: shadowState{Since: "2026-03-01"},
+		},
+		{
+			name:         "promote_on reached",
+			opts:         SourceOptions{Mode: sourceModeShadow, PromoteOn: "2026-03-05"},
+			previous:     shadowState{Since: "2026-03-01"},
+			wantPromoted: true,
+		},
+		{
+			name:         "enough clean days",
+			opts:         SourceOptions{Mode: sourceModeShadow, PromoteAfterCleanDays: 7},
+			previous:     shadowState{Since: "2026-02-20"},
+			wantPromoted: true,
+		},
+		{
+			name:     "recent dirty day restarts the count",
+			opts:     SourceOptions{Mode: sourceModeShadow, PromoteAfterCleanDays: 7},
+			previous: shadowState{Since: "2026-02-20", LastDirty: "2026-03-01"},
+		},
+		{
+			name:      "whitelist overlap today is dirty",
+			opts:      SourceOptions{Mode: sourceModeShadow, PromoteAfterCleanDays: 7},
+			previous:  shadowState{Since: "2026-02-20"},
+			whitelist: whitelist,
+			wantDirty: "2026-03-06",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := map[string]SourceOptions{testShadowURL: tt.opts}
+			previous := map[string]shadowState{testShadowURL: tt.previous}
+
+			enforced, shadow, states := applyShadowMode(blocklist, sources, tt.whitelist, previous, "2026-03-06")
+
+			state := states[testShadowURL]
+			if promoted := state.Promoted != ""; promoted != tt.wantPromoted {
+				t.Errorf("promoted = %v, want %v (state %+v)", promoted, tt.wantPromoted, state)
+			}
+			if tt.wantPromoted && (len(enforced) != 1 || len(shadow) != 0) {
+				t.Errorf("promoted source should be enforced: enforced=%v shadow=%v", enforced, shadow)
+			}
+			if !tt.wantPromoted && (len(enforced) != 0 || len(shadow) != 1) {
+				t.Errorf("shadow source should not be enforced: enforced=%v shadow=%v", enforced, shadow)
+			}
+			if tt.wantDirty != "" && state.LastDirty != tt.wantDirty {
+				t.Errorf("last_dirty = %q, want %q", state.LastDirty, tt.wantDirty)
+			}
+		})
+	}
+}
+
+func TestRenderGeoFileShadowBlock(t *testing.T) {
+	gen := &generation{
+		entries: []blocklistEntry{{addr: "203.0.113.9", label: "ipsum-8"}},
+		shadow:  []blocklistEntry{{addr: "198.51.100.0/24", label: "new-feed"}},
+		sources: map[string]SourceOptions{testShadowURL: {Mode: sourceModeShadow}},
+	}
+
+	got := mustRenderGeoFile(t, gen)
+
+	want := "\n}\n\ngeo $etr_shadow_source {\n    default        \"\";\n\n    198.51.100.0/24    new-feed;\n\n}"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("unexpected geo file:\n%s", got)
+	}
+	if strings.Count(got, "new-feed") != 1 {
+		t.Errorf("shadow entries must not be enforced via $blocked_source:\n%s", got)
+	}
+}
+
+func TestShadowStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), shadowStateFileName)
+
+	states, err := loadShadowState(path)
+	if err != nil || len(states) != 0 {
+		t.Fatalf("missing file should load as empty state, got %v, %v", states, err)
+	}
+
+	want := map[string]shadowState{testShadowURL: {Since: "2026-03-01", Promoted: "2026-03-08"}}
+	if err := saveShadowState(path, want); err != nil {
+		t.Fatalf("saveShadowState: %v", err)
+	}
+	got, err := loadShadowState(path)
+	if err != nil {
+		t.Fatalf("loadShadowState: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// firstSeenFileName holds the date each network first appeared in the blocklist. It lives next
+// to blocklist.conf on the shared volume so the history survives container restarts.
+const firstSeenFileName = ".etr-first-seen.json"
+
+// firstSeenPath returns the location of the first-seen state for a given nginx conf path.
+func firstSeenPath(confFilePath string) string {
+	return filepath.Join(filepath.Dir(confFilePath), firstSeenFileName)
+}
+
+// loadFirstSeen reads the network → first-seen date (YYYY-MM-DD) map.
+// A missing file is not an error: every network is then new.
+func loadFirstSeen(filePath string) (map[string]string, error) {
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	firstSeen := make(map[string]string)
+	if err := json.Unmarshal(data, &firstSeen); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filePath, err)
+	}
+	return firstSeen, nil
+}
+
+// updateFirstSeen returns first-seen dates for the current entries: known networks keep their
+// date, new ones get today, and networks no longer listed are dropped so the file stays bounded.
+func updateFirstSeen(previous map[string]string, entries []blocklistEntry, today string) map[string]string {
+	current := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if date, ok := previous[e.addr]; ok {
+			current[e.addr] = date
+		} else {
+			current[e.addr] = today
+		}
+	}
+	return current
+}
+
+// saveFirstSeen writes the first-seen map atomically.
+func saveFirstSeen(filePath string, firstSeen map[string]string) error {
+	data, err := json.Marshal(firstSeen)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, data)
+}
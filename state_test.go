@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFirstSeenRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), firstSeenFileName)
+
+	previous, err := loadFirstSeen(path)
+	if err != nil || len(previous) != 0 {
+		t.Fatalf("missing file should load as empty, got %v, %v", previous, err)
+	}
+
+	day1 := updateFirstSeen(previous, []blocklistEntry{{addr: "192.0.2.1"}, {addr: "198.51.100.0/24"}}, "2026-01-01")
+	if err := saveFirstSeen(path, day1); err != nil {
+		t.Fatalf("saveFirstSeen: %v", err)
+	}
+
+	loaded, err := loadFirstSeen(path)
+	if err != nil {
+		t.Fatalf("loadFirstSeen: %v", err)
+	}
+	day2 := updateFirstSeen(loaded, []blocklistEntry{{addr: "198.51.100.0/24"}, {addr: "203.0.113.9"}}, "2026-01-02")
+
+	want := map[string]string{
+		"198.51.100.0/24": "2026-01-01", // kept
+		"203.0.113.9":     "2026-01-02", // new
+		// 192.0.2.1 dropped: no longer listed
+	}
+	if !reflect.DeepEqual(day2, want) {
+		t.Errorf("got %v, want %v", day2, want)
+	}
+}
+
+func TestLoadFirstSeenCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), firstSeenFileName)
+	if err := os.WriteFile(path, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFirstSeen(path); err == nil {
+		t.Errorf("expected error for corrupt state file")
+	}
+}
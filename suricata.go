@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Suricata IP reputation limits: category ids run 1..60, scores 1..127, and short names
+// are capped at 32 bytes.
+const (
+	suricataMaxCategories = 60
+	suricataMaxScore      = 127
+	suricataMaxShortName  = 32
+	suricataDefaultScore  = 100
+	suricataCategoriesExt = ".categories"
+	// suricataOverflowCategory is the short name of the category shared by the labels that do
+	// not fit in Suricata's category limit.
+	suricataOverflowCategory = "etr-other"
+)
+
+// renderSuricata renders Suricata IP reputation (iprep) files: the reputation list at out.Path
+// ("<network>,<category id>,<score>") and a categories file at out.Path + ".categories"
+// ("<id>,<short name>,<description>"). Every source label becomes one category, so an address
+// listed by several sources gets one reputation line per source, with the same provenance as
+// $blocked_source in nginx.
+//
+// Suricata has at most 60 categories. With more labels, the highest-scoring (then largest)
+// labels keep their own categories and the rest share the last one, suricataOverflowCategory.
+//
+// A category's score is out.Score when set, otherwise the highest weight configured for the
+// sources carrying that label, otherwise suricataDefaultScore.
+func renderSuricata(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	if out.Score < 0 || out.Score > suricataMaxScore {
+		return nil, fmt.Errorf("suricata score %d out of range 1-%d", out.Score, suricataMaxScore)
+	}
+
+	// Collect the distinct labels, the source URLs behind each and how many entries they list.
+	labelSources := make(map[string][]string)
+	labelEntries := make(map[string]int)
+	for _, e := range gen.entries {
+		for _, src := range e.sources {
+			label := labelFromSource(src)
+			if !slices.Contains(labelSources[label], src) {
+				labelSources[label] = append(labelSources[label], src)
+			}
+			labelEntries[label]++
+		}
+	}
+
+	labels := make([]string, 0, len(labelSources))
+	scores := make(map[string]int, len(labelSources))
+	for label := range labelSources {
+		labels = append(labels, label)
+		scores[label] = suricataScore(out, gen, labelSources[label])
+	}
+
+	var overflow []string
+	if len(labels) > suricataMaxCategories {
+		sort.Slice(labels, func(i, j int) bool {
+			a, b := labels[i], labels[j]
+			if scores[a] != scores[b] {
+				return scores[a] > scores[b]
+			}
+			if labelEntries[a] != labelEntries[b] {
+				return labelEntries[a] > labelEntries[b]
+			}
+			return a < b
+		})
+		labels, overflow = labels[:suricataMaxCategories-1], labels[suricataMaxCategories-1:]
+		sort.Strings(overflow)
+		logf("Suricata output %s: %d source labels share the %q category; Suricata supports at most %d.\n",
+			out.Path, len(overflow), suricataOverflowCategory, suricataMaxCategories)
+	}
+	sort.Strings(labels)
+
+	categoryID := make(map[string]int, len(labelSources))
+	var categories bytes.Buffer
+	for i, label := range labels {
+		categoryID[label] = i + 1
+
+		shortName := label
+		if len(shortName) > suricataMaxShortName {
+			shortName = shortName[:suricataMaxShortName]
+		}
+		sort.Strings(labelSources[label])
+		fmt.Fprintf(&categories, "%d,%s,ETR %s\n", i+1, shortName, joinSources(labelSources[label]))
+	}
+	if len(overflow) > 0 {
+		for _, label := range overflow {
+			categoryID[label] = suricataMaxCategories
+		}
+		fmt.Fprintf(&categories, "%d,%s,ETR %d other sources: %s\n",
+			suricataMaxCategories, suricataOverflowCategory, len(overflow), strings.Join(overflow, " "))
+	}
+
+	var reputation bytes.Buffer
+	for _, e := range gen.entries {
+		n := parseNetwork(e.addr)
+		if n == nil {
+			continue
+		}
+		// One line per category; labels sharing the overflow category keep the highest score.
+		var ids []int
+		best := make(map[int]int)
+		for _, src := range e.sources {
+			label := labelFromSource(src)
+			id := categoryID[label]
+			if _, ok := best[id]; !ok {
+				ids = append(ids, id)
+			}
+			best[id] = max(best[id], scores[label])
+		}
+		for _, id := range ids {
+			fmt.Fprintf(&reputation, "%s,%d,%d\n", n.String(), id, best[id])
+		}
+	}
+
+	return []renderedFile{
+		{path: out.Path, content: reputation.Bytes()},
+		{path: out.Path + suricataCategoriesExt, content: categories.Bytes()},
+	}, nil
+}
+
+// suricataScore picks the score for one category; see renderSuricata.
+func suricataScore(out OutputConfig, gen *generation, sources []string) int {
+	if out.Score > 0 {
+		return out.Score
+	}
+	score := 0
+	for _, src := range sources {
+		if w := gen.sources[sourceKey(src)].Weight; w > score {
+			score = w
+		}
+	}
+	if score == 0 {
+		return suricataDefaultScore
+	}
+	if score > suricataMaxScore {
+		return suricataMaxScore
+	}
+	return score
+}
+
+// joinSources joins source identifiers for a description field. Commas would break the
+// Suricata categories CSV, so sources are space-separated and embedded commas are escaped.
+func joinSources(sources []string) string {
+	return strings.ReplaceAll(strings.Join(sources, " "), ",", "%2C")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const (
+	testIpsumURL       = "https://raw.githubusercontent.com/stamparm/ipsum/refs/heads/master/levels/8.txt"
+	testCompromisedURL = "https://rules.emergingthreats.net/blockrules/compromised-ips.txt"
+)
+
+func TestRenderSuricata(t *testing.T) {
+	gen := &generation{
+		entries: []blocklistEntry{
+			{addr: "198.51.100.0/24", label: "compromised-ips", sources: []string{testCompromisedURL}},
+			{addr: "203.0.113.5", label: "ipsum-8+compromised-ips", sources: []string{testIpsumURL, testCompromisedURL}},
+			{addr: "2001:db8::1", label: "local", sources: []string{"local_blocklist"}},
+		},
+		sources: map[string]SourceOptions{
+			testIpsumURL: {Weight: 120},
+		},
+	}
+
+	files, err := renderSuricata(OutputConfig{Path: "etr.list"}, gen)
+	if err != nil {
+		t.Fatalf("renderSuricata: %v", err)
+	}
+	if len(files) != 2 || files[1].path != "etr.list.categories" {
+		t.Fatalf("expected reputation list and categories file, got %+v", files)
+	}
+
+	wantCategories := "1,compromised-ips,ETR " + testCompromisedURL + "\n" +
+		"2,ipsum-8,ETR " + testIpsumURL + "\n" +
+		"3,local,ETR local_blocklist\n"
+	if got := string(files[1].content); got != wantCategories {
+		t.Errorf("categories:\n%s\nwant:\n%s", got, wantCategories)
+	}
+
+	wantReputation := "198.51.100.0/24,1,100\n" +
+		"203.0.113.5/32,2,120\n" +
+		"203.0.113.5/32,1,100\n" +
+		"2001:db8::1/128,3,100\n"
+	if got := string(files[0].content); got != wantReputation {
+		t.Errorf("reputation:\n%s\nwant:\n%s", got, wantReputation)
+	}
+}
+
+func TestRenderSuricataFixedScore(t *testing.T) {
+	gen := &generation{
+		entries: []blocklistEntry{{addr: "203.0.113.5", sources: []string{testIpsumURL}}},
+		sources: map[string]SourceOptions{testIpsumURL: {Weight: 120}},
+	}
+
+	files, err := renderSuricata(OutputConfig{Path: "etr.list", Score: 42}, gen)
+	if err != nil {
+		t.Fatalf("renderSuricata: %v", err)
+	}
+	if got := string(files[0].content); got != "203.0.113.5/32,1,42\n" {
+		t.Errorf("configured score should override source weight, got %q", got)
+	}
+}
+
+func TestRenderSuricataLimits(t *testing.T) {
+	if _, err := renderSuricata(OutputConfig{Path: "etr.list", Score: 200}, &generation{}); err == nil {
+		t.Errorf("expected error for score above %d", suricataMaxScore)
+	}
+
+}
+
+func TestRenderSuricataOverflowCategory(t *testing.T) {
+	var entries []blocklistEntry
+	sources := make(map[string]SourceOptions)
+	for i := 0; i <= suricataMaxCategories; i++ {
+		src := fmt.Sprintf("https://example.com/list-%02d.txt", i)
+		entries = append(entries, blocklistEntry{addr: fmt.Sprintf("203.0.113.%d", i), sources: []string{src}})
+		sources[src] = SourceOptions{Weight: 10 + i}
+	}
+	files, err := renderSuricata(OutputConfig{Path: "etr.list"}, &generation{entries: entries, sources: sources})
+	if err != nil {
+		t.Fatalf("more labels than categories should not fail the output: %v", err)
+	}
+
+	categories := strings.Split(strings.TrimSpace(string(files[1].content)), "\n")
+	if len(categories) != suricataMaxCategories {
+		t.Fatalf("got %d categories, want %d", len(categories), suricataMaxCategories)
+	}
+	// The two lowest-weighted labels share the overflow category.
+	if want := "60,etr-other,ETR 2 other sources: list-00 list-01"; categories[59] != want {
+		t.Errorf("overflow category = %q, want %q", categories[59], want)
+	}
+	reputation := string(files[0].content)
+	for _, want := range []string{"203.0.113.0/32,60,10\n", "203.0.113.1/32,60,11\n", "203.0.113.2/32,1,12\n"} {
+		if !strings.Contains(reputation, want) {
+			t.Errorf("reputation list missing %q", want)
+		}
+	}
+}
+
+func TestSuricataScoreClampsWeight(t *testing.T) {
+	gen := &generation{sources: map[string]SourceOptions{testIpsumURL: {Weight: 1000}}}
+	if got := suricataScore(OutputConfig{}, gen, []string{testIpsumURL}); got != suricataMaxScore {
+		t.Errorf("weight above %d should clamp, got %d", suricataMaxScore, got)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/moby/moby/api/types/swarm"
+	"github.com/moby/moby/client"
+)
+
+// serviceAPI is the subset of the Docker client used to roll Swarm services.
+// *client.Client satisfies it.
+type serviceAPI interface {
+	ServiceInspect(ctx context.Context, serviceID string, options client.ServiceInspectOptions) (client.ServiceInspectResult, error)
+	ServiceUpdate(ctx context.Context, serviceID string, options client.ServiceUpdateOptions) (client.ServiceUpdateResult, error)
+}
+
+// updateSwarmServices forces a rolling update of each Swarm service, the API equivalent of
+// `docker service update --force`: bumping TaskTemplate.ForceUpdate replaces every task even
+// though the spec is otherwise unchanged, and Swarm applies its own update_config (parallelism,
+// delay, failure action) to the rollout. Every service is attempted; the error lists all that
+// failed.
+func updateSwarmServices(cli serviceAPI, services []string) error {
+	var failures []string
+	for _, service := range services {
+		if err := updateSwarmService(cli, service); err != nil {
+			logf("Failed to update Swarm service %s: %v\n", service, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", service, err))
+			continue
+		}
+		logf("Swarm service %s is rolling its tasks.\n", service)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d/%d Swarm service(s) failed: %s", len(failures), len(services), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func updateSwarmService(cli serviceAPI, service string) error {
+	if err := validateContainerName(service); err != nil {
+		return fmt.Errorf("invalid service name: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerOpTimeout)
+	defer cancel()
+
+	inspected, err := cli.ServiceInspect(ctx, service, client.ServiceInspectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to inspect service: %w", err)
+	}
+	spec := inspected.Service.Spec
+	spec.TaskTemplate.ForceUpdate++
+
+	result, err := cli.ServiceUpdate(ctx, inspected.Service.ID, client.ServiceUpdateOptions{
+		// The version makes the update fail rather than overwrite a concurrent change.
+		Version:          inspected.Service.Version,
+		Spec:             spec,
+		RegistryAuthFrom: swarm.RegistryAuthFromPreviousSpec,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update service: %w", err)
+	}
+	for _, warning := range result.Warnings {
+		logf("Swarm service %s: %s\n", service, warning)
+	}
+	return nil
+}
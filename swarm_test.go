@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/moby/moby/api/types/swarm"
+	"github.com/moby/moby/client"
+)
+
+// fakeSwarmAPI serves the two Engine API endpoints updateSwarmService uses, for one service.
+type fakeSwarmAPI struct {
+	service swarm.Service
+	updates []swarm.ServiceSpec
+	queries []string
+}
+
+func (f *fakeSwarmAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:] // strip the /v1.xx prefix
+	switch {
+	case r.Method == http.MethodGet && path == "/services/"+f.service.Spec.Name:
+		json.NewEncoder(w).Encode(f.service)
+	case r.Method == http.MethodPost && path == "/services/"+f.service.ID+"/update":
+		var spec swarm.ServiceSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.updates = append(f.updates, spec)
+		f.queries = append(f.queries, r.URL.RawQuery)
+		json.NewEncoder(w).Encode(map[string]any{"Warnings": nil})
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "service " + path + " not found"})
+	}
+}
+
+func TestUpdateSwarmServicesForcesUpdate(t *testing.T) {
+	fake := &fakeSwarmAPI{service: swarm.Service{
+		ID:   "svc123",
+		Meta: swarm.Meta{Version: swarm.Version{Index: 42}},
+		Spec: swarm.ServiceSpec{
+			Annotations:  swarm.Annotations{Name: "etr_nginx"},
+			TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:alpine"}, ForceUpdate: 2},
+		},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cli, err := client.New(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithAPIVersion(client.MaxAPIVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	err = updateSwarmServices(cli, []string{"etr_nginx", "missing"})
+	if err == nil || !strings.Contains(err.Error(), "1/2 Swarm service(s) failed: missing:") {
+		t.Fatalf("expected only the missing service to fail, got %v", err)
+	}
+
+	if len(fake.updates) != 1 {
+		t.Fatalf("got %d service updates, want 1", len(fake.updates))
+	}
+	if got := fake.updates[0].TaskTemplate.ForceUpdate; got != 3 {
+		t.Errorf("ForceUpdate = %d, want 3", got)
+	}
+	if got := fake.updates[0].TaskTemplate.ContainerSpec.Image; got != "nginx:alpine" {
+		t.Errorf("the rest of the spec must be preserved, image = %q", got)
+	}
+	if !strings.Contains(fake.queries[0], "version=42") {
+		t.Errorf("update should carry the inspected version, query %q", fake.queries[0])
+	}
+}
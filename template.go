@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateData is what a user-supplied output template is executed with.
+type templateData struct {
+	// Entries are the carved networks in address order, with the same provenance as the json output.
+	Entries []exportRecord
+	// Shadow are the carved matches of shadow-mode sources (see applyShadowMode).
+	Shadow []exportRecord
+	Run    templateRun
+}
+
+// templateRun describes the run that produced the entries.
+type templateRun struct {
+	GeneratedAt time.Time
+	Instance    string // INSTANCE_NAME, if set
+	Name        string // the output's name (default "etr")
+	Whitelist   int    // number of whitelist entries applied
+}
+
+// templateFuncs are available to every output template in addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"join":   strings.Join,
+	"isIPv6": func(network string) bool { return strings.Contains(network, ":") },
+}
+
+// renderTemplate executes the Go text/template file named by out.Template, for formats the
+// project does not ship natively. Template parse and execution errors (including references to
+// missing map keys) fail the run during rendering, before any file is written.
+func renderTemplate(out OutputConfig, gen *generation) ([]renderedFile, error) {
+	if out.Template == "" {
+		return nil, fmt.Errorf("template is required")
+	}
+	text, err := os.ReadFile(out.Template)
+	if err != nil {
+		return nil, fmt.Errorf("read template: %v", err)
+	}
+	tmpl, err := template.New(filepath.Base(out.Template)).
+		Funcs(templateFuncs).
+		Option("missingkey=error").
+		Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %v", err)
+	}
+
+	data := templateData{
+		Entries: exportRecords(gen),
+		Shadow:  exportRecords(&generation{entries: gen.shadow, whitelist: gen.whitelist, sources: gen.sources}),
+		Run: templateRun{
+			GeneratedAt: gen.generatedAt,
+			Instance:    gen.instance,
+			Name:        outputName(out),
+			Whitelist:   len(gen.whitelist),
+		},
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, fmt.Errorf("execute template: %v", err)
+	}
+	return []renderedFile{{path: out.Path, content: b.Bytes()}}, nil
+}
+
+// geoTemplateData is what the nginx_geo_template is executed with.
+type geoTemplateData struct {
+	// Entries are the carved networks in address order. Empty in the per_source layout.
+	Entries []geoTemplateEntry
+	// Includes are the etr.d include paths as nginx sees them. Only set in the per_source layout.
+	Includes []string
+	// Run describes the run; Name is empty.
+	Run templateRun
+}
+
+// geoTemplateEntry is one line of the geo block.
+type geoTemplateEntry struct {
+	Network string
+	Label   string
+}
+
+// loadGeoTemplate parses the nginx_geo_template file and checks it with sample data, so a
+// broken template fails at startup instead of on the next write.
+// The template renders the geo $blocked_source block (and anything around it); the run header
+// above it and the $etr_action and $etr_shadow_source blocks below it stay generated.
+func loadGeoTemplate(templatePath string) (*template.Template, error) {
+	text, err := os.ReadFile(templatePath)
+	if err != nil {
+		return nil, fmt.Errorf("read template: %v", err)
+	}
+	tmpl, err := template.New(filepath.Base(templatePath)).
+		Funcs(templateFuncs).
+		Option("missingkey=error").
+		Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %v", err)
+	}
+
+	// Each layout's sample must come out with its entry or include, so a template that ignores
+	// one of them cannot write an empty geo block.
+	samples := []struct {
+		data geoTemplateData
+		want string
+	}{
+		{geoTemplateData{Entries: []geoTemplateEntry{{Network: "192.0.2.0/24", Label: "sample"}}}, "192.0.2.0/24"},
+		{geoTemplateData{Includes: []string{path.Join(defaultNginxIncludeDir, "sample.conf")}}, "sample.conf"},
+	}
+	for _, sample := range samples {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, sample.data); err != nil {
+			return nil, fmt.Errorf("execute template: %v", err)
+		}
+		if !hasGeoBlock(b.String()) {
+			return nil, fmt.Errorf("template must render a geo $blocked_source block closed by a line holding only \"}\"")
+		}
+		if !strings.Contains(b.String(), sample.want) {
+			return nil, fmt.Errorf("template must render both .Entries and .Includes")
+		}
+	}
+	return tmpl, nil
+}
+
+// hasGeoBlock reports whether content opens geo $blocked_source and closes it on a line of its
+// own, the layout readLiveGeoEntries expects.
+func hasGeoBlock(content string) bool {
+	inBlock := false
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if !inBlock {
+			inBlock = opensBlockedSourceGeo(line)
+		} else if line == "}" {
+			return true
+		}
+	}
+	return false
+}
+
+// renderGeoTemplate executes the geo template for the entries or, in the per_source layout,
+// the include paths.
+func renderGeoTemplate(b *bytes.Buffer, gen *generation, entries []blocklistEntry, includes []string) error {
+	data := geoTemplateData{
+		Includes: includes,
+		Run: templateRun{
+			GeneratedAt: gen.generatedAt,
+			Instance:    gen.instance,
+			Whitelist:   len(gen.whitelist),
+		},
+	}
+	if includes == nil {
+		data.Entries = make([]geoTemplateEntry, len(entries))
+		for i, e := range entries {
+			data.Entries[i] = geoTemplateEntry{Network: e.addr, Label: e.label}
+		}
+	}
+	return gen.geoTemplate.Execute(b, data)
+}
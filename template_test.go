@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func writeTestTemplate(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "out.tmpl")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	return path
+}
+
+func TestRenderTemplate(t *testing.T) {
+	tmpl := writeTestTemplate(t, `# {{.Run.Name}} for {{.Run.Instance}} at {{.Run.GeneratedAt.Format "2006-01-02"}}
+{{range .Entries}}{{if isIPv6 .Network}}v6{{else}}v4{{end}} {{.Network}} score={{.Score}} labels={{range $i, $s := .Sources}}{{if $i}},{{end}}{{$s.Label}}{{end}}
+{{end}}`)
+	gen := &generation{
+		entries: []blocklistEntry{
+			{addr: "192.0.2.1", label: "ipsum-8+compromised-ips", sources: []string{testIpsumURL, testCompromisedURL}},
+			{addr: "2001:db8::/32", label: "ipsum-8", sources: []string{testIpsumURL}},
+		},
+		generatedAt: time.Date(2026, 3, 14, 2, 30, 0, 0, time.UTC),
+		instance:    "prod-eu",
+	}
+
+	files, err := renderTemplate(OutputConfig{Path: "out.txt", Name: "edge", Template: tmpl}, gen)
+	if err != nil {
+		t.Fatalf("renderTemplate: %v", err)
+	}
+
+	want := "# edge for prod-eu at 2026-03-14\n" +
+		"v4 192.0.2.1 score=2 labels=ipsum-8,compromised-ips\n" +
+		"v6 2001:db8::/32 score=1 labels=ipsum-8\n"
+	if got := string(files[0].content); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRenderTemplateErrorsFailBeforeWriting(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		template string
+		wantErr  string
+	}{
+		{name: "missing", template: filepath.Join(dir, "missing.tmpl"), wantErr: "read template"},
+		{name: "parse", template: writeTestTemplate(t, "{{range .Entries}}"), wantErr: "parse template"},
+		{name: "execute", template: writeTestTemplate(t, "{{.Run.Nope}}"), wantErr: "template"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonPath := filepath.Join(dir, tt.name+".json")
+			rendered, err := renderOutputs([]OutputConfig{
+				{Format: "json", Path: jsonPath},
+				{Format: "template", Path: filepath.Join(dir, tt.name+".txt"), Template: tt.template},
+			}, &generation{})
+			var templateErr *templateOutputError
+			if !errors.As(err, &templateErr) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected a template error containing %q, got %v", tt.wantErr, err)
+			}
+			if rendered != nil {
+				t.Errorf("a failing template must fail the run, got rendered outputs %+v", rendered)
+			}
+			if _, err := os.Stat(jsonPath); !os.IsNotExist(err) {
+				t.Errorf("no output should be written when a template fails, stat err = %v", err)
+			}
+		})
+	}
+}
+
+const testGeoTemplate = `# Managed by ETR.
+geo $remote_addr $blocked_source {
+	default "-";
+{{range .Entries}}	{{.Network}} {{.Label}};
+{{end}}{{range .Includes}}	include {{.}};
+{{end}}}
+`
+
+func TestGeoTemplate(t *testing.T) {
+	tmpl, err := loadGeoTemplate(writeTestTemplate(t, testGeoTemplate))
+	if err != nil {
+		t.Fatalf("loadGeoTemplate: %v", err)
+	}
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "blocklist.conf")
+	gen := &generation{
+		entries: []blocklistEntry{
+			{addr: "192.0.2.1", label: "ipsum-8"},
+			{addr: "203.0.113.0/24", label: "local"},
+		},
+		geoTemplate: tmpl,
+	}
+
+	if err := writeGeoFile(gen, confPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeWhitelistFile(nil, whitelistConfPath(confPath)); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Managed by ETR.\ngeo $remote_addr $blocked_source {\n\tdefault \"-\";\n\t192.0.2.1 ipsum-8;\n\t203.0.113.0/24 local;\n}\n"
+	if !strings.HasPrefix(string(content), "# blocklist.conf\n\n") || !strings.HasSuffix(string(content), "\n"+want) {
+		t.Errorf("unexpected blocklist.conf:\n%s", content)
+	}
+	if !nginxFilesUnchanged(gen, confPath, "", "") {
+		t.Error("templated file is not recognised as unchanged")
+	}
+
+	// The per_source layout hands the template include paths instead of entries.
+	if err := writePerSourceGeoFiles(gen, confPath, defaultNginxIncludeDir); err != nil {
+		t.Fatal(err)
+	}
+	live, err := readLiveGeoEntries(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 2 || live["192.0.2.1"] != "ipsum-8" || live["203.0.113.0/24"] != "local" {
+		t.Errorf("live entries = %v", live)
+	}
+}
+
+func TestGeoTemplateExecutionErrorKeepsLiveFiles(t *testing.T) {
+	confPath := filepath.Join(t.TempDir(), "blocklist.conf")
+	gen := &generation{entries: []blocklistEntry{{addr: "192.0.2.1", label: "ipsum-8"}}}
+	if err := writeGeoFile(gen, confPath); err != nil {
+		t.Fatal(err)
+	}
+	live, err := os.ReadFile(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parses, but fails when executed, as a template can on data the startup check did not cover.
+	gen.geoTemplate = template.Must(template.New("geo").Parse(
+		"geo $blocked_source {\n{{.Run.Nope}}{{range .Entries}}{{end}}{{range .Includes}}{{end}}}\n"))
+	for _, layout := range []string{geoLayoutSingle, geoLayoutPerSource} {
+		if nginxFilesUnchanged(gen, confPath, layout, "") {
+			t.Errorf("%s: a failing template must not count as unchanged", layout)
+		}
+		write := writeGeoFile
+		if layout == geoLayoutPerSource {
+			write = func(gen *generation, path string) error { return writePerSourceGeoFiles(gen, path, "") }
+		}
+		if err := write(gen, confPath); err == nil || !strings.Contains(err.Error(), "nginx_geo_template") {
+			t.Errorf("%s: expected the template error, got %v", layout, err)
+		}
+	}
+	if got, _ := os.ReadFile(confPath); string(got) != string(live) {
+		t.Errorf("blocklist.conf was replaced:\n%s", got)
+	}
+}
+
+func TestLoadGeoTemplateRejectsBrokenTemplates(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  string
+	}{
+		{name: "parse", template: "{{range .Entries}}", wantErr: "parse template"},
+		{name: "execute", template: "{{range .Entries}}{{.Address}}{{end}}", wantErr: "execute template"},
+		{name: "no geo block", template: "map $remote_addr $blocked_source {\n}\n", wantErr: "geo $blocked_source"},
+		{name: "no includes", template: "geo $blocked_source {\n{{range .Entries}}{{.Network}} {{.Label}};\n{{end}}}\n", wantErr: ".Includes"},
+		{name: "unclosed", template: "geo $blocked_source {\n{{range .Entries}}{{.Network}} {{.Label}}; {{end}}}", wantErr: "geo $blocked_source"},
+	}
+	for _, tt := range tests {
+		_, err := loadGeoTemplate(writeTestTemplate(t, tt.template))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGeoTemplateReadmeExampleMatchesDefault(t *testing.T) {
+	tmpl, err := loadGeoTemplate(writeTestTemplate(t, "geo $blocked_source {\n    default        \"\";\n\n{{range .Entries}}    {{.Network}}    {{.Label}};\n{{end}}{{range .Includes}}    include {{.}};\n{{end}}\n}"))
+	if err != nil {
+		t.Fatalf("loadGeoTemplate: %v", err)
+	}
+	gen := &generation{entries: []blocklistEntry{{addr: "192.0.2.1", label: "ipsum-8"}, {addr: "2001:db8::/32", label: "local"}}}
+	want := mustRenderGeoFile(t, gen)
+	gen.geoTemplate = tmpl
+	if got := mustRenderGeoFile(t, gen); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
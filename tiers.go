@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Severity tiers a source can be assigned via source_options, from most to least severe.
+const (
+	tierBlock     = "block"
+	tierChallenge = "challenge"
+	tierRatelimit = "ratelimit"
+)
+
+// tierSeverity ranks tiers; an address listed by several sources gets the most severe tier.
+var tierSeverity = map[string]int{
+	tierBlock:     3,
+	tierChallenge: 2,
+	tierRatelimit: 1,
+}
+
+// validateSourceOptions rejects per-source settings nginx could not act on.
+func validateSourceOptions(sources map[string]SourceOptions) error {
+	for source, opts := range sources {
+		if opts.Tier != "" && tierSeverity[opts.Tier] == 0 {
+			return fmt.Errorf("source %q: unknown tier %q (want block, challenge or ratelimit)", source, opts.Tier)
+		}
+		if opts.Mode != "" && opts.Mode != sourceModeEnforce && opts.Mode != sourceModeShadow {
+			return fmt.Errorf("source %q: unknown mode %q (want enforce or shadow)", source, opts.Mode)
+		}
+		if opts.Format != "" && opts.Format != sourceFormatPlain && opts.Format != sourceFormatRules {
+			return fmt.Errorf("source %q: unknown format %q (want plain or rules)", source, opts.Format)
+		}
+		if opts.RuleSide != "" && opts.RuleSide != ruleSideSrc && opts.RuleSide != ruleSideDst && opts.RuleSide != ruleSideBoth {
+			return fmt.Errorf("source %q: unknown rule_side %q (want src, dst or both)", source, opts.RuleSide)
+		}
+		if opts.PromoteOn != "" {
+			if _, err := time.Parse(dateLayout, opts.PromoteOn); err != nil {
+				return fmt.Errorf("source %q: promote_on %q is not a YYYY-MM-DD date", source, opts.PromoteOn)
+			}
+		}
+		if opts.PromoteAfterCleanDays < 0 {
+			return fmt.Errorf("source %q: promote_after_clean_days must not be negative", source)
+		}
+	}
+	return nil
+}
+
+// tiersConfigured reports whether any source has an explicit tier. Without one, every match is
+// "block" and $blocked_source alone says everything, so no $etr_action map is emitted.
+func tiersConfigured(sources map[string]SourceOptions) bool {
+	for _, opts := range sources {
+		if opts.Tier != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// tier returns the most severe tier among an entry's sources; sources without one are "block".
+func (gen *generation) tier(e blocklistEntry) string {
+	best := ""
+	for _, src := range e.sources {
+		t := gen.sources[sourceKey(src)].Tier
+		if t == "" {
+			t = tierBlock
+		}
+		if tierSeverity[t] > tierSeverity[best] {
+			best = t
+		}
+	}
+	if best == "" {
+		return tierBlock
+	}
+	return best
+}
+
+// renderTierMap renders "map $blocked_source $etr_action" mapping every label in the geo block to
+// its tier, so nginx can hard-block top-tier lists and only challenge or rate-limit the rest from
+// the same include file. Unblocked clients map to "". Entries sharing a label share a tier; if
+// their sources disagree, the most severe tier wins.
+func renderTierMap(gen *generation) []byte {
+	tiers := make(map[string]string)
+	for _, e := range gen.entries {
+		t := gen.tier(e)
+		if tierSeverity[t] > tierSeverity[tiers[e.label]] {
+			tiers[e.label] = t
+		}
+	}
+	labels := make([]string, 0, len(tiers))
+	for label := range tiers {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var b bytes.Buffer
+	b.WriteString("map $blocked_source $etr_action {\n    default        \"\";\n\n")
+	for _, label := range labels {
+		fmt.Fprintf(&b, "    %s    %s;\n", label, tiers[label])
+	}
+	b.WriteString("\n}")
+	return b.Bytes()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderGeoFileTierMap(t *testing.T) {
+	const lowURL = "https://raw.githubusercontent.com/stamparm/ipsum/refs/heads/master/levels/3.txt"
+	gen := &generation{
+		entries: []blocklistEntry{
+			{addr: "192.0.2.1", label: "ipsum-3", sources: []string{lowURL}},
+			{addr: "192.0.2.2", label: "ipsum-3+ipsum-8", sources: []string{lowURL, testIpsumURL}},
+			{addr: "192.0.2.3", label: "compromised-ips", sources: []string{testCompromisedURL}},
+		},
+		sources: map[string]SourceOptions{
+			lowURL:             {Tier: tierRatelimit},
+			testCompromisedURL: {Tier: tierChallenge},
+		},
+	}
+
+	got := mustRenderGeoFile(t, gen)
+
+	want := "\n}\n\nmap $blocked_source $etr_action {\n    default        \"\";\n\n" +
+		"    compromised-ips    challenge;\n" +
+		"    ipsum-3    ratelimit;\n" +
+		"    ipsum-3+ipsum-8    block;\n" +
+		"\n}"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("unexpected tier map:\n%s", got)
+	}
+}
+
+func TestRenderGeoFileWithoutTiers(t *testing.T) {
+	gen := &generation{
+		entries: []blocklistEntry{{addr: "192.0.2.1", label: "ipsum-8", sources: []string{testIpsumURL}}},
+		sources: map[string]SourceOptions{testIpsumURL: {Weight: 5}},
+	}
+
+	if got := mustRenderGeoFile(t, gen); strings.Contains(got, "$etr_action") {
+		t.Errorf("no tier map expected when no source has a tier:\n%s", got)
+	}
+}
+
+func TestValidateSourceOptions(t *testing.T) {
+	if err := validateSourceOptions(map[string]SourceOptions{testIpsumURL: {Tier: tierChallenge}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateSourceOptions(map[string]SourceOptions{testIpsumURL: {Tier: "drop"}}); err == nil {
+		t.Error("expected an error for an unknown tier")
+	}
+	if err := validateSourceOptions(map[string]SourceOptions{testIpsumURL: {Format: sourceFormatRules, RuleSide: ruleSideDst}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateSourceOptions(map[string]SourceOptions{testIpsumURL: {Format: "csv"}}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if err := validateSourceOptions(map[string]SourceOptions{testIpsumURL: {RuleSide: "any"}}); err == nil {
+		t.Error("expected an error for an unknown rule_side")
+	}
+}